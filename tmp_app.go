@@ -38,10 +38,10 @@ func Run(root *rootCommand) error {
 }
 {{if .has.database}}
 // TerminateConnections will close connections to app dependencies.
-func TerminateConnections(db *database.Connection) {
-	err := db.Close()
+func TerminateConnections(connections *database.Connections) {
+	err := connections.Close()
 	if err != nil {
-		log.Fatalf("failed to close database connection: %q", err)
+		log.Fatalf("failed to close database connections: %q", err)
 	}
 }
 {{end}}
@@ -59,6 +59,8 @@ func Container() *di.Container {
         di.Invoke(registerSubCommands),
 		{{- if .has.restAPI}}
 		provideRESTAPIEndpoints(),
+		provideAPIKeyStores(),
+		provideIdempotencyStores(),
 		di.Provide(rest.NewAPIServer),
 		di.Invoke(rest.RegisterAPIEndpoints),
 		{{- end}}
@@ -69,6 +71,12 @@ func Container() *di.Container {
 		provideDatabase(),
 		provideRepositories(),
 		{{- end}}
+		{{- if .has.crypto}}
+		provideCrypto(),
+		{{- end}}
+		{{- if .has.storage}}
+		provideStorage(),
+		{{- end}}
 	)
 	if err != nil {
 		log.Fatalf("failed to create DI container: %q", err)
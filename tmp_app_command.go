@@ -2,6 +2,8 @@ package app
 
 import (
 	"context"
+	"os"
+	"path/filepath"
 
 	"github.com/spf13/cobra"
 	{{range .imports}}
@@ -24,6 +26,13 @@ type (
 
 	rootCommand    Command
 	startAPIServer Command
+	openAPICommand Command
+	openAPIExport  Command
+	dbCommand      Command
+	migrateTenants Command
+	seed           Command
+	cryptoCommand  Command
+	reencrypt      Command
 )
 
 func startRootCommand() *rootCommand {
@@ -58,4 +67,196 @@ func startAPIServerCommand(
 func (startAPIServer *startAPIServer) AddTo(root *rootCommand) {
 	root.AddCommand(startAPIServer.Command)
 }
+
+func startOpenAPICommand(export *openAPIExport) *openAPICommand {
+	command := &openAPICommand{
+		&cobra.Command{
+			Use:   "openapi",
+			Short: "work with the OpenAPI document of the REST API",
+			Long:  "This command groups the commands that work with the OpenAPI document of the REST API",
+		},
+	}
+
+	command.AddCommand(export.Command)
+
+	return command
+}
+
+func (command *openAPICommand) AddTo(root *rootCommand) {
+	root.AddCommand(command.Command)
+}
+
+func startOpenAPIExportCommand(apiServer *rest.APIServer) *openAPIExport {
+	var format, output string
+
+	command := &openAPIExport{
+		&cobra.Command{
+			Use:   "export",
+			Short: "write the OpenAPI document",
+			Long: "This command writes the OpenAPI document generated from the registered endpoints, for example " +
+				"to generate API clients from",
+			RunE: func(cmd *cobra.Command, args []string) error {
+				encode := (*rest.OpenAPI).JSON
+				if format == "yaml" {
+					encode = (*rest.OpenAPI).YAML
+				}
+
+				content, err := encode(apiServer.OpenAPI())
+				if err != nil {
+					return err
+				}
+
+				if output == "" {
+					_, err = cmd.OutOrStdout().Write(content)
+					return err
+				}
+
+				return os.WriteFile(output, content, 0o644) //nolint:gosec
+			},
+		},
+	}
+
+	command.Flags().StringVar(&format, "format", "json", "format of the document, json or yaml")
+	command.Flags().StringVarP(&output, "output", "o", "", "file to write the document to, stdout by default")
+
+	return command
+}
+{{end}}
+{{if .has.database}}
+func startDBCommand(migrateTenants *migrateTenants, seed *seed) *dbCommand {
+	db := &dbCommand{
+		&cobra.Command{
+			Use:   "db",
+			Short: "manage the application database",
+			Long:  "This command groups the commands that manage the application database",
+		},
+	}
+
+	db.AddCommand(migrateTenants.Command, seed.Command)
+
+	return db
+}
+
+func (db *dbCommand) AddTo(root *rootCommand) {
+	root.AddCommand(db.Command)
+}
+
+func startMigrateTenantsCommand(ctx context.Context, connection *database.Connection) *migrateTenants {
+	var (
+		dir     string
+		tenants []string
+	)
+
+	command := &migrateTenants{
+		&cobra.Command{
+			Use:   "migrate-tenants",
+			Short: "apply tenant migrations to tenant schemas",
+			Long: "This command applies the migrations in --dir to the schema of every tenant that has one, " +
+				"or to the tenants given with --tenant, creating their schemas when needed",
+			RunE: func(cmd *cobra.Command, args []string) error {
+				if len(tenants) == 0 {
+					ids, err := connection.TenantIDs(ctx)
+					if err != nil {
+						return err
+					}
+
+					tenants = ids
+				}
+
+				if err := connection.MigrateTenants(ctx, dir, tenants); err != nil {
+					return err
+				}
+
+				cmd.Printf("migrated %d tenant schemas\n", len(tenants))
+
+				return nil
+			},
+		},
+	}
+
+	command.Flags().StringVar(&dir, "dir", "migrations/tenant", "directory with the tenant migration files")
+	command.Flags().StringSliceVar(&tenants, "tenant", nil, "tenant to migrate, repeat to migrate several tenants")
+
+	return command
+}
+
+func startSeedCommand(ctx context.Context, connection *database.Connection) *seed {
+	var dir string
+
+	command := &seed{
+		&cobra.Command{
+			Use:   "seed [set]",
+			Short: "load fixtures into the database",
+			Long: "This command loads the fixture files of a set, by default dev, from --dir/<set> into the database " +
+				"in a single transaction",
+			Args: cobra.MaximumNArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				set := "dev"
+				if len(args) == 1 {
+					set = args[0]
+				}
+
+				count, err := fixtures.Load(ctx, connection, filepath.Join(dir, set))
+				if err != nil {
+					return err
+				}
+
+				cmd.Printf("loaded %d rows from the %s fixtures\n", count, set)
+
+				return nil
+			},
+		},
+	}
+
+	command.Flags().StringVar(&dir, "dir", "fixtures", "directory with one sub directory of fixture files per set")
+
+	return command
+}
+{{end}}
+{{if .has.crypto}}
+func startCryptoCommand(reencrypt *reencrypt) *cryptoCommand {
+	command := &cryptoCommand{
+		&cobra.Command{
+			Use:   "crypto",
+			Short: "manage encrypted data",
+			Long:  "This command groups the commands that manage encrypted data and encryption keys",
+		},
+	}
+
+	command.AddCommand(reencrypt.Command)
+
+	return command
+}
+
+func (command *cryptoCommand) AddTo(root *rootCommand) {
+	root.AddCommand(command.Command)
+}
+
+func startReencryptCommand(ctx context.Context, connection *database.Connection, cipher *crypto.Cipher) *reencrypt {
+	var target crypto.Reencryption
+
+	command := &reencrypt{
+		&cobra.Command{
+			Use:   "reencrypt",
+			Short: "re-encrypt a column with the active key",
+			Long: "This command rewrites, in batches, every value of an encrypted column that was not encrypted " +
+				"with the active key, so that retired keys can be removed",
+			RunE: func(cmd *cobra.Command, args []string) error {
+				rewritten, err := cipher.Reencrypt(ctx, connection, target)
+				cmd.Printf("re-encrypted %d rows of %s.%s\n", rewritten, target.Table, target.Column)
+
+				return err
+			},
+		},
+	}
+
+	command.Flags().StringVar(&target.Table, "table", "", "table that holds the encrypted column")
+	command.Flags().StringVar(&target.Column, "column", "", "encrypted column to rewrite")
+	command.Flags().StringVar(&target.KeyColumn, "key-column", "id", "column that identifies a row")
+	command.Flags().IntVar(&target.BatchSize, "batch-size", 500, "number of rows rewritten per transaction")
+	_ = command.MarkFlagRequired("table")
+	_ = command.MarkFlagRequired("column")
+
+	return command
+}
 {{end}}
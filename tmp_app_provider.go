@@ -10,6 +10,16 @@ import (
 func provideCliCommands() di.Option {
 	return di.Options(
 		di.Provide(startRootCommand),
+		{{- if .has.restAPI}}
+		di.Provide(startOpenAPIExportCommand),
+		{{- end}}
+		{{- if .has.database}}
+		di.Provide(startMigrateTenantsCommand),
+		di.Provide(startSeedCommand),
+		{{- end}}
+		{{- if .has.crypto}}
+		di.Provide(startReencryptCommand),
+		{{- end}}
 	)
 }
 
@@ -17,6 +27,13 @@ func provideSubCommands() di.Option {
 	return di.Options(
 	    {{- if .has.restAPI}}
 		di.Provide(startAPIServerCommand, di.As(new(subCommand))),
+		di.Provide(startOpenAPICommand, di.As(new(subCommand))),
+		{{- end}}
+		{{- if .has.database}}
+		di.Provide(startDBCommand, di.As(new(subCommand))),
+		{{- end}}
+		{{- if .has.crypto}}
+		di.Provide(startCryptoCommand, di.As(new(subCommand))),
 		{{- end}}
 	)
 }
@@ -35,6 +52,25 @@ func provideRESTAPIEndpoints() di.Option {
 		di.Provide(rest.NewDocsEndpoint, di.As(new(rest.Endpoint))),
 		di.Provide(rest.NewStatusEndpoint, di.As(new(rest.Endpoint))),
 		di.Provide(rest.NewExampleEndpoint, di.As(new(rest.Endpoint))),
+		di.Provide(rest.NewExampleSocketEndpoint, di.As(new(rest.Endpoint))),
+	)
+}
+
+func provideAPIKeyStores() di.Option {
+	return di.Options(
+		di.Provide(rest.NewConfigAPIKeyStore, di.As(new(rest.APIKeyStore))),
+		{{- if .has.database}}
+		di.Provide(repository.NewAPIKeyRepository, di.As(new(rest.APIKeyStore))),
+		{{- end}}
+	)
+}
+
+func provideIdempotencyStores() di.Option {
+	return di.Options(
+		di.Provide(rest.NewIdempotencyStore, di.As(new(rest.IdempotencyStore))),
+		{{- if .has.database}}
+		di.Provide(repository.NewIdempotencyRepository, di.As(new(rest.IdempotencyStore))),
+		{{- end}}
 	)
 }
 {{end}}
@@ -42,6 +78,7 @@ func provideRESTAPIEndpoints() di.Option {
 func provideDatabase() di.Option {
 	return di.Options(
 		di.Provide(database.NewDatabase),
+		di.Provide(database.NewConnections),
 		di.Provide(database.NewHealthChecker),
 	)
 }
@@ -58,5 +95,17 @@ func provideHTTPClients() di.Option {
 	)
 }
 {{- end}}
-
-
+{{if .has.storage}}
+func provideStorage() di.Option {
+	return di.Options(
+		di.Provide(storage.NewBlobStore),
+	)
+}
+{{- end}}
+{{if .has.crypto}}
+func provideCrypto() di.Option {
+	return di.Options(
+		di.Provide(crypto.NewCipher),
+	)
+}
+{{- end}}
@@ -0,0 +1,202 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+type (
+	// Cipher encrypts values with the active key and decrypts values sealed with any key in its keyring.
+	// Ciphertexts look like <key id>:<base64 nonce and sealed data>, so rotating keys only needs the new key to be
+	// added and made active; older keys stay in the keyring until every value has been re-encrypted.
+	Cipher struct {
+		activeKeyID string
+		keys        map[string]cipher.AEAD
+	}
+
+	config struct {
+		// Keys are given as id:base64key pairs, for example CRYPTO_KEYS="2024-01:...,2024-07:...".
+		Keys map[string]string `envconfig:"CRYPTO_KEYS"`
+		// KeysDir holds one file per key, named after the key id and containing the base64 encoded key.
+		KeysDir     string `envconfig:"CRYPTO_KEYS_DIR"`
+		ActiveKeyID string `envconfig:"CRYPTO_ACTIVE_KEY_ID"`
+	}
+)
+
+const (
+	keySize      = 32
+	keyIDDivider = ":"
+)
+
+var (
+	// ErrUnknownKey is returned when a ciphertext was sealed with a key that is not in the keyring.
+	ErrUnknownKey = errors.New("unknown encryption key")
+
+	// ErrNotConfigured is returned by Encrypt and Reencrypt when no active key is configured.
+	ErrNotConfigured = errors.New("encryption is not configured, set CRYPTO_ACTIVE_KEY_ID")
+
+	// ErrMalformedCiphertext is returned when a value does not look like a ciphertext produced by Cipher.
+	ErrMalformedCiphertext = errors.New("malformed ciphertext")
+
+	keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	encoding     = base64.RawStdEncoding
+)
+
+// NewCipher returns a Cipher with the keys found in CRYPTO_KEYS and CRYPTO_KEYS_DIR.
+// Keys are 32 random bytes encoded as base64, for example the output of `openssl rand -base64 32`.
+// Without CRYPTO_ACTIVE_KEY_ID the application still starts and decrypts with the keys found, but the Cipher refuses
+// to encrypt.
+func NewCipher() *Cipher {
+	cfg := newConfig()
+
+	keys := make(map[string]string, len(cfg.Keys))
+	for id, key := range cfg.Keys {
+		keys[id] = key
+	}
+
+	if cfg.KeysDir != "" {
+		if err := readKeysDir(cfg.KeysDir, keys); err != nil {
+			log.Fatalf("failed to read encryption keys: %q", err)
+		}
+	}
+
+	c, err := newCipher(cfg.ActiveKeyID, keys)
+	if err != nil {
+		log.Fatalf("failed to create cipher: %q", err)
+	}
+
+	return c
+}
+
+func newCipher(activeKeyID string, encodedKeys map[string]string) (*Cipher, error) {
+	c := &Cipher{
+		activeKeyID: activeKeyID,
+		keys:        make(map[string]cipher.AEAD, len(encodedKeys)),
+	}
+
+	for id, encodedKey := range encodedKeys {
+		if !keyIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+		if err != nil {
+			return nil, fmt.Errorf("decode key %s: %w", id, err)
+		}
+
+		if len(key) != keySize {
+			return nil, fmt.Errorf("key %s has %d bytes, want %d", id, len(key), keySize)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		c.keys[id] = aead
+	}
+
+	if _, ok := c.keys[activeKeyID]; !ok && activeKeyID != "" {
+		return nil, fmt.Errorf("active key %q: %w", activeKeyID, ErrUnknownKey)
+	}
+
+	return c, nil
+}
+
+// ActiveKeyID returns the id of the key new values are encrypted with.
+func (c *Cipher) ActiveKeyID() string {
+	return c.activeKeyID
+}
+
+// Encrypt seals plaintext with the active key.
+func (c *Cipher) Encrypt(plaintext []byte) (string, error) {
+	aead, ok := c.keys[c.activeKeyID]
+	if !ok {
+		return "", ErrNotConfigured
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(c.activeKeyID))
+
+	return c.activeKeyID + keyIDDivider + encoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a ciphertext sealed with any key in the keyring.
+func (c *Cipher) Decrypt(ciphertext string) ([]byte, error) {
+	id, encoded, ok := strings.Cut(ciphertext, keyIDDivider)
+	if !ok {
+		return nil, ErrMalformedCiphertext
+	}
+
+	aead, ok := c.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key %q: %w", id, ErrUnknownKey)
+	}
+
+	sealed, err := encoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, ErrMalformedCiphertext
+	}
+
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, sealed, []byte(id))
+}
+
+// IsCurrent reports whether ciphertext was sealed with the active key.
+func (c *Cipher) IsCurrent(ciphertext string) bool {
+	return strings.HasPrefix(ciphertext, c.activeKeyID+keyIDDivider)
+}
+
+func readKeysDir(dir string, keys map[string]string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		// skip directories and the hidden ..data links Kubernetes creates for mounted secrets
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		key, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		keys[entry.Name()] = string(key)
+	}
+
+	return nil
+}
+
+func newConfig() *config {
+	cfg := new(config)
+	err := envconfig.Process("", cfg)
+	if err != nil {
+		log.Fatalf("failed to load configuration: %q", err)
+	}
+
+	return cfg
+}
@@ -0,0 +1,183 @@
+package crypto
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// encryptedTag marks the struct fields that are stored encrypted, for example
+	// Email string `db:"email" encrypted:"true"`. Tagged fields must be a string, *string or []byte. Repositories
+	// read and write rows with such fields through Cipher Get, Select and NamedExec, so that they are decrypted on
+	// scan and encrypted on insert and update.
+	encryptedTag = "encrypted"
+)
+
+var errNotStruct = errors.New("value is not a struct or a slice of structs")
+
+// EncryptFields replaces the value of every field of v tagged as encrypted with its ciphertext.
+// v must be a pointer to a struct. Empty values are left as they are.
+func (c *Cipher) EncryptFields(v interface{}) error {
+	return walk(v, func(plaintext []byte) ([]byte, error) {
+		ciphertext, err := c.Encrypt(plaintext)
+		return []byte(ciphertext), err
+	})
+}
+
+// DecryptFields replaces the value of every field of v tagged as encrypted with its plaintext.
+// v must be a pointer to a struct or to a slice of structs. Empty values are left as they are.
+func (c *Cipher) DecryptFields(v interface{}) error {
+	return walk(v, func(ciphertext []byte) ([]byte, error) {
+		return c.Decrypt(string(ciphertext))
+	})
+}
+
+// Get runs a query that returns one row, scans it into dest and decrypts the fields tagged as encrypted.
+func (c *Cipher) Get(
+	ctx context.Context,
+	db sqlx.QueryerContext,
+	dest interface{},
+	query string,
+	args ...interface{},
+) error {
+	if err := sqlx.GetContext(ctx, db, dest, query, args...); err != nil {
+		return err
+	}
+
+	return c.DecryptFields(dest)
+}
+
+// Select runs a query, scans the rows into the slice dest and decrypts the fields tagged as encrypted.
+func (c *Cipher) Select(
+	ctx context.Context,
+	db sqlx.QueryerContext,
+	dest interface{},
+	query string,
+	args ...interface{},
+) error {
+	if err := sqlx.SelectContext(ctx, db, dest, query, args...); err != nil {
+		return err
+	}
+
+	return c.DecryptFields(dest)
+}
+
+// NamedExec encrypts the fields of arg tagged as encrypted and runs a named insert or update with them.
+// arg is copied first, so the caller keeps the plaintext values.
+func (c *Cipher) NamedExec(ctx context.Context, db sqlx.ExtContext, query string, arg interface{}) (sql.Result, error) {
+	value := reflect.Indirect(reflect.ValueOf(arg))
+	if value.Kind() != reflect.Struct {
+		return nil, errNotStruct
+	}
+
+	encrypted := reflect.New(value.Type())
+	encrypted.Elem().Set(value)
+
+	if err := c.EncryptFields(encrypted.Interface()); err != nil {
+		return nil, err
+	}
+
+	return sqlx.NamedExecContext(ctx, db, query, encrypted.Interface())
+}
+
+func walk(v interface{}, transform func([]byte) ([]byte, error)) error {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return errNotStruct
+	}
+
+	value = value.Elem()
+
+	switch value.Kind() {
+	case reflect.Struct:
+		return walkStruct(value, transform)
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			element := reflect.Indirect(value.Index(i))
+			if element.Kind() != reflect.Struct {
+				return errNotStruct
+			}
+
+			if err := walkStruct(element, transform); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	default:
+		return errNotStruct
+	}
+}
+
+func walkStruct(value reflect.Value, transform func([]byte) ([]byte, error)) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+
+		if field.Anonymous && value.Field(i).Kind() == reflect.Struct {
+			if err := walkStruct(value.Field(i), transform); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if field.Tag.Get(encryptedTag) != "true" {
+			continue
+		}
+
+		if err := transformField(value.Field(i), transform); err != nil {
+			return fmt.Errorf("field %s: %w", field.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func transformField(field reflect.Value, transform func([]byte) ([]byte, error)) error {
+	if field.Kind() == reflect.Ptr {
+		if field.IsNil() {
+			return nil
+		}
+
+		// work on a copy so that a struct copied by NamedExec does not change the value its caller points to
+		copied := reflect.New(field.Type().Elem())
+		copied.Elem().Set(field.Elem())
+		field.Set(copied)
+
+		field = copied.Elem()
+	}
+
+	switch {
+	case field.Kind() == reflect.String:
+		if field.Len() == 0 {
+			return nil
+		}
+
+		transformed, err := transform([]byte(field.String()))
+		if err != nil {
+			return err
+		}
+
+		field.SetString(string(transformed))
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Uint8:
+		if field.Len() == 0 {
+			return nil
+		}
+
+		transformed, err := transform(field.Bytes())
+		if err != nil {
+			return err
+		}
+
+		field.SetBytes(transformed)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// Reencryption names the encrypted text column that Reencrypt rewrites and the column that identifies a row.
+	// Key values are read as text and compared as parameters, so integer, uuid and text keys all work.
+	Reencryption struct {
+		Table     string
+		KeyColumn string
+		Column    string
+		BatchSize int
+	}
+
+	encryptedValue struct {
+		Key   string `db:"key"`
+		Value string `db:"value"`
+	}
+)
+
+const defaultBatchSize = 500
+
+// Reencrypt rewrites every value of target.Column that was not sealed with the active key, in batches ordered by
+// target.KeyColumn. Each batch runs in its own transaction and only updates rows whose value did not change since
+// it was read, so it is safe to run while the application is serving traffic. It returns the number of rows
+// rewritten.
+func (c *Cipher) Reencrypt(ctx context.Context, connection *database.Connection, target Reencryption) (int64, error) {
+	if c.activeKeyID == "" {
+		return 0, ErrNotConfigured
+	}
+
+	if target.BatchSize <= 0 {
+		target.BatchSize = defaultBatchSize
+	}
+
+	var (
+		rewritten int64
+		lastKey   *string
+	)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return rewritten, err
+		}
+
+		var values []encryptedValue
+		err := connection.SelectContext(ctx, &values, target.selectQuery(lastKey != nil), target.args(c, lastKey)...)
+		if err != nil {
+			return rewritten, fmt.Errorf("select batch from %s: %w", target.Table, err)
+		}
+
+		if len(values) == 0 {
+			return rewritten, nil
+		}
+
+		tx, err := connection.BeginTxx(ctx, nil)
+		if err != nil {
+			return rewritten, err
+		}
+
+		count, err := c.reencryptBatch(ctx, tx, target, values)
+		if err != nil {
+			_ = tx.Rollback()
+			return rewritten, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return rewritten, err
+		}
+
+		rewritten += count
+		lastKey = &values[len(values)-1].Key
+	}
+}
+
+func (c *Cipher) reencryptBatch(
+	ctx context.Context,
+	tx *sqlx.Tx,
+	target Reencryption,
+	values []encryptedValue,
+) (int64, error) {
+	var rewritten int64
+
+	for _, value := range values {
+		plaintext, err := c.Decrypt(value.Value)
+		if err != nil {
+			return rewritten, fmt.Errorf("decrypt %s %s: %w", target.Table, value.Key, err)
+		}
+
+		ciphertext, err := c.Encrypt(plaintext)
+		if err != nil {
+			return rewritten, err
+		}
+
+		result, err := tx.ExecContext(ctx, target.updateQuery(), ciphertext, value.Key, value.Value)
+		if err != nil {
+			return rewritten, fmt.Errorf("update %s %s: %w", target.Table, value.Key, err)
+		}
+
+		count, err := result.RowsAffected()
+		if err != nil {
+			return rewritten, err
+		}
+
+		rewritten += count
+	}
+
+	return rewritten, nil
+}
+
+func (target Reencryption) selectQuery(after bool) string {
+	query := fmt.Sprintf(
+		`SELECT %[1]s::text AS key, %[2]s AS value FROM %[3]s WHERE %[2]s <> '' AND NOT starts_with(%[2]s, $1)`,
+		database.QuoteIdentifier(target.KeyColumn),
+		database.QuoteIdentifier(target.Column),
+		database.QuoteIdentifier(target.Table),
+	)
+
+	if after {
+		query += fmt.Sprintf(` AND %s > $3`, database.QuoteIdentifier(target.KeyColumn))
+	}
+
+	return query + fmt.Sprintf(` ORDER BY %s LIMIT $2`, database.QuoteIdentifier(target.KeyColumn))
+}
+
+func (target Reencryption) args(c *Cipher, lastKey *string) []interface{} {
+	args := []interface{}{c.activeKeyID + keyIDDivider, target.BatchSize}
+	if lastKey != nil {
+		args = append(args, *lastKey)
+	}
+
+	return args
+}
+
+func (target Reencryption) updateQuery() string {
+	return fmt.Sprintf(
+		`UPDATE %[1]s SET %[2]s = $1 WHERE %[3]s = $2 AND %[2]s = $3`,
+		database.QuoteIdentifier(target.Table),
+		database.QuoteIdentifier(target.Column),
+		database.QuoteIdentifier(target.KeyColumn),
+	)
+}
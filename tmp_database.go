@@ -3,7 +3,11 @@ package database
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"regexp"
+	"strings"
 	"time"
     {{if .uses.postgres}}
 	_ "github.com/lib/pq" // Blank import to load and register the PostgreSQL driver.
@@ -22,14 +26,35 @@ import (
 type (
 	Connection struct {
 		*sqlx.DB
+
+		name      string
+		config    *config
+		collector *telemetry.MetricsCollector
+	}
+
+	// Connections holds the default Connection and every named Connection listed in DATABASE_CONNECTIONS.
+	// Repositories that need a named database take Connections and pick one with Named.
+	Connections struct {
+		connections map[string]*Connection
+		names       []string
 	}
 
+	// config is loaded with a prefix: DATABASE for the default connection and DATABASE_<NAME> for named ones,
+	// for example DATABASE_ANALYTICS_DSN.
 	config struct {
-		DSN                string        `envconfig:"DATABASE_DSN" required:"true"`
-		MaxOpenConns       int           `envconfig:"DATABASE_MAX_OPEN_CONNS" default:"50"`
-		MaxIdleConns       int           `envconfig:"DATABASE_MAX_IDLE_CONNS" default:"50"`
-		ConnMaxLifetime    time.Duration `envconfig:"DATABASE_CONN_MAX_LIFETIME" default:"30m"`
-		ConnMaxIdleTimeout time.Duration `envconfig:"DATABASE_CONN_MAX_IDLE_TIMEOUT" default:"10m"`
+		DSN                string        `split_words:"true" required:"true"`
+		Name               string        `split_words:"true"`
+		MaxOpenConns       int           `split_words:"true" default:"50"`
+		MaxIdleConns       int           `split_words:"true" default:"50"`
+		ConnMaxLifetime    time.Duration `split_words:"true" default:"30m"`
+		ConnMaxIdleTimeout time.Duration `split_words:"true" default:"10m"`
+		TenantMode         string        `split_words:"true" default:"schema"`
+		TenantSchemaPrefix string        `split_words:"true" default:"tenant_"`
+		TenantSetting      string        `split_words:"true" default:"app.tenant"`
+	}
+
+	connectionsConfig struct {
+		Names []string `envconfig:"DATABASE_CONNECTIONS"`
 	}
 )
 
@@ -38,12 +63,55 @@ const (
 	dbDriver = "postgres"
 	{{- end}}
 
-	timeout = time.Second * 10
+	// DefaultConnection is the name of the connection configured by the DATABASE_* variables.
+	DefaultConnection = "default"
+
+	configPrefix = "DATABASE"
+	timeout      = time.Second * 10
 )
 
-// NewDatabase returns a database Connection.
+// connectionName keeps names usable in environment variables and metric names.
+var connectionName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// NewDatabase returns the default database Connection.
 func NewDatabase(instrumentation *telemetry.Instrumentation) *Connection {
-	dbCfg := newConfig()
+	return newConnection(DefaultConnection, instrumentation)
+}
+
+// NewConnections returns the default Connection together with every named Connection.
+func NewConnections(defaultConnection *Connection, instrumentation *telemetry.Instrumentation) *Connections {
+	connections := &Connections{
+		connections: map[string]*Connection{DefaultConnection: defaultConnection},
+		names:       []string{DefaultConnection},
+	}
+
+	for _, name := range newConnectionsConfig().Names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		if !connectionName.MatchString(name) {
+			log.Fatalf(
+				"database connection name %q in DATABASE_CONNECTIONS is invalid, use letters, digits and underscores "+
+					"starting with a letter, for example read_replica",
+				name,
+			)
+		}
+
+		if _, ok := connections.connections[name]; ok {
+			log.Fatalf("database connection %q is configured more than once", name)
+		}
+
+		connections.connections[name] = newConnection(name, instrumentation)
+		connections.names = append(connections.names, name)
+	}
+
+	return connections
+}
+
+func newConnection(name string, instrumentation *telemetry.Instrumentation) *Connection {
+	dbCfg := newConfig(name)
 
 	driver, err := otelsql.Register(
 		dbDriver,
@@ -51,20 +119,21 @@ func NewDatabase(instrumentation *telemetry.Instrumentation) *Connection {
 		otelsql.TraceQueryWithoutArgs(),
 		otelsql.TraceRowsClose(),
 		otelsql.TraceRowsAffected(),
-		otelsql.WithDatabaseName("{{.databaseName}}"),
+		otelsql.WithDatabaseName(dbCfg.Name),
+		otelsql.WithInstanceName(name),
 		otelsql.WithDefaultAttributes(semconv.ServiceName(instrumentation.ServiceName())),
 	)
 	if err != nil {
-		log.Fatalf("failed to register an otelsql driver: %q", err)
+		log.Fatalf("failed to register an otelsql driver for %s database: %q", name, err)
 	}
 
 	db, err := sql.Open(driver, dbCfg.DSN)
 	if err != nil {
-		log.Fatalf("failed to open new database connection: %q", err)
+		log.Fatalf("failed to open new %s database connection: %q", name, err)
 	}
 
 	if err := db.Ping(); err != nil {
-		log.Fatalf("failed to ping database: %q", err)
+		log.Fatalf("failed to ping %s database: %q", name, err)
 	}
 
 	db.SetMaxIdleConns(dbCfg.MaxIdleConns)
@@ -72,30 +141,156 @@ func NewDatabase(instrumentation *telemetry.Instrumentation) *Connection {
 	db.SetConnMaxLifetime(dbCfg.ConnMaxLifetime)
 	db.SetConnMaxIdleTime(dbCfg.ConnMaxIdleTimeout)
 
-	if err := otelsql.RecordStats(db); err != nil {
-		log.Fatalf("failed to record database statistics: %q", err)
+	if err := otelsql.RecordStats(
+		db,
+		otelsql.WithDatabaseName(dbCfg.Name),
+		otelsql.WithInstanceName(name),
+	); err != nil {
+		log.Fatalf("failed to record %s database statistics: %q", name, err)
+	}
+
+	return &Connection{
+		DB:        sqlx.NewDb(db, dbDriver),
+		name:      name,
+		config:    dbCfg,
+		collector: newMetricsCollector(metricsName(name), instrumentation),
 	}
+}
+
+// Name returns the name the connection was configured with.
+func (connection *Connection) Name() string {
+	return connection.name
+}
+
+// DSN returns the data source name the connection was opened with.
+func (connection *Connection) DSN() string {
+	return connection.config.DSN
+}
+
+// WithDB returns a copy of connection that runs its queries on db, for example a database whose queries all run in
+// one transaction in tests. The copy keeps the name, configuration and metrics of connection.
+func (connection *Connection) WithDB(db *sqlx.DB) *Connection {
+	return &Connection{
+		DB:        db,
+		name:      connection.name,
+		config:    connection.config,
+		collector: connection.collector,
+	}
+}
+
+func (connection *Connection) inTransaction(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	tx, err := connection.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
 
-	return &Connection{sqlx.NewDb(db, dbDriver)}
+// Named returns the connection configured under name. It stops the application when there is no such connection,
+// because a missing database is a configuration error that should surface at start up.
+func (connections *Connections) Named(name string) *Connection {
+	connection, ok := connections.connections[name]
+	if !ok {
+		log.Fatalf("database connection %q is not configured, add it to DATABASE_CONNECTIONS", name)
+	}
+
+	return connection
 }
 
-// NewHealthChecker returns an instance of a database health checker.
-func NewHealthChecker(database *Connection) health.Checker {
-	return health.NewChecker(
-		health.WithCheck(
+// Default returns the default connection.
+func (connections *Connections) Default() *Connection {
+	return connections.Named(DefaultConnection)
+}
+
+// Close closes every connection.
+func (connections *Connections) Close() error {
+	var errs []error
+	for _, name := range connections.names {
+		if err := connections.connections[name].Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close %s database connection: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// NewHealthChecker returns an instance of a database health checker with a check for every connection.
+func NewHealthChecker(connections *Connections) health.Checker {
+	options := make([]health.CheckerOption, 0, len(connections.names))
+	for _, name := range connections.names {
+		connection := connections.connections[name]
+
+		options = append(options, health.WithCheck(
 			health.Check{
-				Name: "database",
+				Name: metricsName(name),
 				Check: func(ctx context.Context) error {
-					return database.PingContext(ctx)
+					return connection.PingContext(ctx)
 				},
 				Timeout: timeout,
 			},
-		),
+		))
+	}
+
+	return health.NewChecker(options...)
+}
+
+func newMetricsCollector(name string, instrumentation *telemetry.Instrumentation) *telemetry.MetricsCollector {
+	collector := telemetry.NewMetricsCollector(
+		name,
+		telemetry.TotalOperations(),
+		telemetry.LatencyWithLabels(),
+		telemetry.RowsAffectedWithLabels(),
+	)
+
+	instrumentation.Registry().MustRegister(
+		collector.Counter(),
+		collector.LatencyVec(),
+		collector.RowsVec(),
 	)
+
+	return collector
+}
+
+// metricsName returns "database" for the default connection and "database_<name>" for named ones.
+func metricsName(name string) string {
+	if name == DefaultConnection {
+		return "database"
+	}
+
+	return "database_" + name
 }
 
-func newConfig() *config {
+func newConfig(name string) *config {
+	prefix := configPrefix
+	if name != DefaultConnection {
+		prefix = configPrefix + "_" + strings.ToUpper(name)
+	}
+
 	cfg := new(config)
+	err := envconfig.Process(prefix, cfg)
+	if err != nil {
+		log.Fatalf("failed to load %s database configuration: %q", name, err)
+	}
+
+	if cfg.Name == "" && name == DefaultConnection {
+		cfg.Name = "{{.databaseName}}"
+	}
+
+	if cfg.Name == "" {
+		cfg.Name = name
+	}
+
+	return cfg
+}
+
+func newConnectionsConfig() *connectionsConfig {
+	cfg := new(connectionsConfig)
 	err := envconfig.Process("", cfg)
 	if err != nil {
 		log.Fatalf("failed to load configuration: %q", err)
@@ -103,3 +298,32 @@ func newConfig() *config {
 
 	return cfg
 }
+
+// QuoteIdentifier quotes a possibly schema-qualified identifier such as public.users.
+func QuoteIdentifier(identifier string) string {
+	parts := strings.Split(identifier, ".")
+	for i, part := range parts {
+		parts[i] = quoteIdentifier(part)
+	}
+
+	return strings.Join(parts, ".")
+}
+
+func quoteIdentifiers(identifiers []string) string {
+	quoted := make([]string, 0, len(identifiers))
+	for _, identifier := range identifiers {
+		quoted = append(quoted, quoteIdentifier(identifier))
+	}
+
+	return strings.Join(quoted, ", ")
+}
+
+// quoteIdentifier quotes name as standard SQL does, doubling its quotes. Like PostgreSQL, it drops what follows a NUL
+// character.
+func quoteIdentifier(name string) string {
+	if end := strings.IndexRune(name, 0); end >= 0 {
+		name = name[:end]
+	}
+
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
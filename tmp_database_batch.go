@@ -0,0 +1,307 @@
+package database
+{{if .uses.postgres}}
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+type (
+	// Upsert describes a multi-row INSERT ... ON CONFLICT statement.
+	// Leave ConflictColumns empty for a plain insert and UpdateColumns empty for ON CONFLICT DO NOTHING.
+	Upsert struct {
+		Table           string
+		Columns         []string
+		ConflictColumns []string
+		UpdateColumns   []string
+	}
+
+	// RowSource yields the rows streamed by CopyFrom. It returns io.EOF when there are no more rows.
+	RowSource func() ([]interface{}, error)
+)
+
+const (
+	// maxBindParameters is the maximum number of bind parameters PostgreSQL accepts in one statement.
+	maxBindParameters = 65535
+
+	bulkUpsertMethod = "bulk_upsert"
+	copyFromMethod   = "copy_from"
+)
+
+var errNoColumns = errors.New("no columns given")
+
+// BulkInsert inserts rows into table using multi-row INSERT statements.
+func (connection *Connection) BulkInsert(
+	ctx context.Context,
+	table string,
+	columns []string,
+	rows [][]interface{},
+) (int64, error) {
+	return connection.BulkUpsert(ctx, Upsert{Table: table, Columns: columns}, rows)
+}
+
+// BulkUpsert writes rows with multi-row INSERT ... ON CONFLICT statements. Rows are split into chunks that stay
+// under the bind parameter limit and every chunk runs in the same transaction. PostgreSQL cannot update a row twice
+// in one statement, so when rows repeat the values of the conflict columns only the last of them is written.
+func (connection *Connection) BulkUpsert(ctx context.Context, upsert Upsert, rows [][]interface{}) (int64, error) {
+	if len(upsert.Columns) == 0 {
+		return 0, fmt.Errorf("bulk upsert into %s: %w", upsert.Table, errNoColumns)
+	}
+
+	connection.collector.RecordTotalOpsMetric()
+	startTime := time.Now()
+	defer connection.collector.RecordLatencyMetricWithLabels(startTime, bulkUpsertMethod)
+
+	rows, err := upsert.dedupe(rows)
+	if err != nil {
+		return 0, fmt.Errorf("bulk upsert into %s: %w", upsert.Table, err)
+	}
+
+	chunkSize := maxBindParameters / len(upsert.Columns)
+
+	var affected int64
+	err = connection.inTransaction(ctx, func(tx *sqlx.Tx) error {
+		for start := 0; start < len(rows); start += chunkSize {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			query, args, err := upsert.build(rows[start:min(start+chunkSize, len(rows))])
+			if err != nil {
+				return err
+			}
+
+			result, err := tx.ExecContext(ctx, query, args...)
+			if err != nil {
+				return err
+			}
+
+			count, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+
+			affected += count
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("bulk upsert into %s: %w", upsert.Table, err)
+	}
+
+	connection.collector.RecordRowsAffectedMetric(bulkUpsertMethod, affected)
+
+	return affected, nil
+}
+
+// CopyFrom streams rows from source into table using the PostgreSQL COPY FROM protocol. Use it for loads that are
+// too large for BulkUpsert; it does not support conflict handling.
+func (connection *Connection) CopyFrom(
+	ctx context.Context,
+	table string,
+	columns []string,
+	source RowSource,
+) (int64, error) {
+	if len(columns) == 0 {
+		return 0, fmt.Errorf("copy into %s: %w", table, errNoColumns)
+	}
+
+	connection.collector.RecordTotalOpsMetric()
+	startTime := time.Now()
+	defer connection.collector.RecordLatencyMetricWithLabels(startTime, copyFromMethod)
+
+	var copied int64
+	err := connection.inTransaction(ctx, func(tx *sqlx.Tx) error {
+		stmt, err := tx.PrepareContext(ctx, copyInStatement(table, columns))
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			_ = stmt.Close()
+		}()
+
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			row, err := source()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if _, err := stmt.ExecContext(ctx, row...); err != nil {
+				return err
+			}
+
+			copied++
+		}
+
+		_, err = stmt.ExecContext(ctx)
+
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("copy into %s: %w", table, err)
+	}
+
+	connection.collector.RecordRowsAffectedMetric(copyFromMethod, copied)
+
+	return copied, nil
+}
+
+// RowsFromSlice returns a RowSource that yields the given rows.
+func RowsFromSlice(rows [][]interface{}) RowSource {
+	next := 0
+
+	return func() ([]interface{}, error) {
+		if next >= len(rows) {
+			return nil, io.EOF
+		}
+
+		next++
+
+		return rows[next-1], nil
+	}
+}
+
+// dedupe drops the rows whose conflict column values a later row repeats, keeping the order of the others. Rows
+// of a plain insert or of ON CONFLICT DO NOTHING are returned as they are.
+func (upsert Upsert) dedupe(rows [][]interface{}) ([][]interface{}, error) {
+	if len(upsert.ConflictColumns) == 0 || len(upsert.UpdateColumns) == 0 {
+		return rows, nil
+	}
+
+	indexes := make([]int, 0, len(upsert.ConflictColumns))
+	for _, conflict := range upsert.ConflictColumns {
+		index := slices.Index(upsert.Columns, conflict)
+		if index < 0 {
+			return nil, fmt.Errorf("conflict column %s is not one of the columns", conflict)
+		}
+
+		indexes = append(indexes, index)
+	}
+
+	last := make(map[string]int, len(rows))
+	keys := make([]string, len(rows))
+	duplicates := false
+
+	for i, row := range rows {
+		if len(row) != len(upsert.Columns) {
+			return nil, fmt.Errorf("row %d has %d values, want %d", i, len(row), len(upsert.Columns))
+		}
+
+		key := make([]interface{}, 0, len(indexes))
+		for _, index := range indexes {
+			key = append(key, keyValue(row[index]))
+		}
+
+		// NULL never conflicts, such rows are all inserted
+		if slices.Contains(key, nil) {
+			continue
+		}
+
+		keys[i] = fmt.Sprintf("%#v", key)
+		if _, ok := last[keys[i]]; ok {
+			duplicates = true
+		}
+
+		last[keys[i]] = i
+	}
+
+	if !duplicates {
+		return rows, nil
+	}
+
+	deduped := make([][]interface{}, 0, len(rows))
+	for i, row := range rows {
+		if keys[i] == "" || last[keys[i]] == i {
+			deduped = append(deduped, row)
+		}
+	}
+
+	return deduped, nil
+}
+
+// keyValue returns value as the database sees it, so that pointers and driver.Valuer values such as sql.NullString
+// compare by what they hold. Values the driver converts itself are kept as they are.
+func keyValue(value interface{}) interface{} {
+	converted, err := driver.DefaultParameterConverter.ConvertValue(value)
+	if err != nil {
+		return value
+	}
+
+	return converted
+}
+
+func (upsert Upsert) build(rows [][]interface{}) (string, []interface{}, error) {
+	var query strings.Builder
+
+	args := make([]interface{}, 0, len(rows)*len(upsert.Columns))
+
+	fmt.Fprintf(&query, "INSERT INTO %s (%s) VALUES ", QuoteIdentifier(upsert.Table), quoteIdentifiers(upsert.Columns))
+
+	for i, row := range rows {
+		if len(row) != len(upsert.Columns) {
+			return "", nil, fmt.Errorf("row %d has %d values, want %d", i, len(row), len(upsert.Columns))
+		}
+
+		if i > 0 {
+			query.WriteString(", ")
+		}
+
+		query.WriteString("(")
+		for j, value := range row {
+			if j > 0 {
+				query.WriteString(", ")
+			}
+
+			args = append(args, value)
+			fmt.Fprintf(&query, "$%d", len(args))
+		}
+		query.WriteString(")")
+	}
+
+	if len(upsert.ConflictColumns) == 0 {
+		return query.String(), args, nil
+	}
+
+	fmt.Fprintf(&query, " ON CONFLICT (%s)", quoteIdentifiers(upsert.ConflictColumns))
+
+	if len(upsert.UpdateColumns) == 0 {
+		query.WriteString(" DO NOTHING")
+		return query.String(), args, nil
+	}
+
+	updates := make([]string, 0, len(upsert.UpdateColumns))
+	for _, column := range upsert.UpdateColumns {
+		updates = append(updates, fmt.Sprintf("%[1]s = EXCLUDED.%[1]s", quoteIdentifier(column)))
+	}
+
+	fmt.Fprintf(&query, " DO UPDATE SET %s", strings.Join(updates, ", "))
+
+	return query.String(), args, nil
+}
+
+func copyInStatement(table string, columns []string) string {
+	if schema, name, ok := strings.Cut(table, "."); ok {
+		return pq.CopyInSchema(schema, name, columns...)
+	}
+
+	return pq.CopyIn(table, columns...)
+}
+{{- end}}
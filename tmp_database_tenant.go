@@ -0,0 +1,181 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+const (
+	// TenantModeSchema keeps every tenant in its own schema and sets search_path per transaction.
+	TenantModeSchema = "schema"
+
+	// TenantModeRowLevelSecurity keeps tenants in shared tables and sets a session variable that row-level
+	// security policies compare against, for example USING (tenant_id = current_setting('app.tenant')).
+	TenantModeRowLevelSecurity = "rls"
+)
+
+// WithTenant runs fn in a transaction scoped to the tenant carried by ctx. Depending on DATABASE_TENANT_MODE it
+// either points search_path at the tenant schema or sets DATABASE_TENANT_SETTING for row-level security policies.
+// Both only last until the transaction ends, so pooled connections never leak a tenant to the next caller.
+func (connection *Connection) WithTenant(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	id, ok := tenant.FromContext(ctx)
+	if !ok {
+		return tenant.ErrMissing
+	}
+
+	if err := tenant.Validate(id); err != nil {
+		return err
+	}
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("tenant", id))
+
+	return connection.inTransaction(ctx, func(tx *sqlx.Tx) error {
+		if err := connection.applyTenant(ctx, tx, id); err != nil {
+			return fmt.Errorf("apply tenant %s: %w", id, err)
+		}
+
+		return fn(tx)
+	})
+}
+
+// TenantSchema returns the name of the schema that holds the tables of tenant id.
+func (connection *Connection) TenantSchema(id string) string {
+	return connection.config.TenantSchemaPrefix + id
+}
+
+// TenantIDs returns every tenant that has a schema in the database.
+func (connection *Connection) TenantIDs(ctx context.Context) ([]string, error) {
+	var schemas []string
+
+	err := connection.SelectContext(
+		ctx,
+		&schemas,
+		`SELECT schema_name FROM information_schema.schemata WHERE starts_with(schema_name, $1) ORDER BY schema_name`,
+		connection.config.TenantSchemaPrefix,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(schemas))
+	for _, schema := range schemas {
+		ids = append(ids, strings.TrimPrefix(schema, connection.config.TenantSchemaPrefix))
+	}
+
+	return ids, nil
+}
+
+// MigrateTenants applies the *.up.sql files in dir, in file name order, to the schema of every tenant. The schema
+// is created when it does not exist and applied versions are tracked in a schema_migrations table inside it.
+// Each tenant is migrated in its own transaction.
+func (connection *Connection) MigrateTenants(ctx context.Context, dir string, tenants []string) error {
+	if connection.config.TenantMode != TenantModeSchema {
+		return fmt.Errorf("tenant migrations need tenant mode %q, got %q", TenantModeSchema, connection.config.TenantMode)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.up.sql"))
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(files)
+
+	for _, id := range tenants {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := tenant.Validate(id); err != nil {
+			return fmt.Errorf("migrate tenant %q: %w", id, err)
+		}
+
+		if err := connection.migrateTenant(ctx, id, files); err != nil {
+			return fmt.Errorf("migrate tenant %s: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+func (connection *Connection) migrateTenant(ctx context.Context, id string, files []string) error {
+	schema := pq.QuoteIdentifier(connection.TenantSchema(id))
+
+	return connection.inTransaction(ctx, func(tx *sqlx.Tx) error {
+		statements := []string{
+			fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", schema),
+			fmt.Sprintf("SET LOCAL search_path TO %s, public", schema),
+			`CREATE TABLE IF NOT EXISTS schema_migrations (
+				version TEXT PRIMARY KEY,
+				applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+			)`,
+		}
+
+		for _, statement := range statements {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+
+		var versions []string
+		if err := tx.SelectContext(ctx, &versions, `SELECT version FROM schema_migrations`); err != nil {
+			return err
+		}
+
+		applied := make(map[string]bool, len(versions))
+		for _, version := range versions {
+			applied[version] = true
+		}
+
+		for _, file := range files {
+			version := strings.TrimSuffix(filepath.Base(file), ".up.sql")
+			if applied[version] {
+				continue
+			}
+
+			migration, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+
+			if _, err := tx.ExecContext(ctx, string(migration)); err != nil {
+				return fmt.Errorf("apply %s: %w", version, err)
+			}
+
+			if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (connection *Connection) applyTenant(ctx context.Context, tx *sqlx.Tx, id string) error {
+	var err error
+
+	switch connection.config.TenantMode {
+	case TenantModeSchema:
+		_, err = tx.ExecContext(
+			ctx,
+			fmt.Sprintf("SET LOCAL search_path TO %s, public", pq.QuoteIdentifier(connection.TenantSchema(id))),
+		)
+	case TenantModeRowLevelSecurity:
+		_, err = tx.ExecContext(ctx, `SELECT set_config($1, $2, true)`, connection.config.TenantSetting, id)
+	default:
+		err = fmt.Errorf("unknown tenant mode %q", connection.config.TenantMode)
+	}
+
+	return err
+}
@@ -0,0 +1,57 @@
+package databasetest
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-txdb"
+	"github.com/jmoiron/sqlx"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+const txDBDriver = "txdb"
+
+var (
+	txDBMutex   sync.Mutex
+	txDBDrivers = map[string]bool{}
+)
+
+// Transaction returns a copy of connection for the duration of test t whose queries all run in one transaction,
+// rolled back when the test finishes, so that tests can share one database. Transactions begun on the copy are
+// folded into that transaction. The fixtures in dirs are loaded through the copy first.
+func Transaction(t testing.TB, connection *database.Connection, dirs ...string) *database.Connection {
+	t.Helper()
+
+	driver := txDBDriver + "_" + connection.Name()
+
+	txDBMutex.Lock()
+	if !txDBDrivers[driver] {
+		txdb.Register(driver, connection.DriverName(), connection.DSN())
+		txDBDrivers[driver] = true
+	}
+	txDBMutex.Unlock()
+
+	db, err := sqlx.Open(driver, t.Name())
+	if err != nil {
+		t.Fatalf("failed to open transactional database connection: %q", err)
+	}
+
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Errorf("failed to roll back test transaction: %q", err)
+		}
+	})
+
+	transactional := connection.WithDB(sqlx.NewDb(db.DB, connection.DriverName()))
+
+	for _, dir := range dirs {
+		if _, err := fixtures.Load(context.Background(), transactional, dir); err != nil {
+			t.Fatalf("failed to load fixtures from %s: %q", dir, err)
+		}
+	}
+
+	return transactional
+}
@@ -0,0 +1,323 @@
+package fixtures
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/yaml.v3"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// Fixture is the content of one fixture file. Files are YAML or JSON, for example:
+	//
+	//	table: orders
+	//	depends_on: [users]
+	//	rows:
+	//	  - _name: first
+	//	    user_id: '{{"{{"}} ref "users.alice.id" {{"}}"}}'
+	//	    created_at: '{{"{{"}} offset "-48h" {{"}}"}}'
+	//
+	// String values are Go templates that can call now, offset "<duration>", uuid, seq "<name>" and
+	// ref "<table>.<row name>.<column>". A row gets a name with the _name key so that rows loaded later can refer
+	// to any of its columns, including those the database fills in such as a serial id.
+	Fixture struct {
+		Table     string                   `yaml:"table" json:"table"`
+		DependsOn []string                 `yaml:"depends_on" json:"depends_on"`
+		Rows      []map[string]interface{} `yaml:"rows" json:"rows"`
+	}
+
+	loader struct {
+		now       time.Time
+		sequences map[string]int
+		rows      map[string]map[string]interface{}
+	}
+)
+
+const (
+	rowNameKey = "_name"
+)
+
+// Load inserts the fixtures found in dir into the database in one transaction and returns the number of rows.
+func Load(ctx context.Context, connection *database.Connection, dir string) (int, error) {
+	tx, err := connection.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := LoadTx(ctx, tx, dir)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	return count, tx.Commit()
+}
+
+// LoadTx inserts the fixtures found in dir using tx. Tables are loaded after the tables they depend on.
+func LoadTx(ctx context.Context, tx *sqlx.Tx, dir string) (int, error) {
+	fixtures, err := read(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	ordered, err := order(fixtures)
+	if err != nil {
+		return 0, err
+	}
+
+	l := &loader{
+		now:       time.Now().UTC(),
+		sequences: map[string]int{},
+		rows:      map[string]map[string]interface{}{},
+	}
+
+	var count int
+	for _, fixture := range ordered {
+		for i, row := range fixture.Rows {
+			if err := l.insert(ctx, tx, fixture.Table, row); err != nil {
+				return count, fmt.Errorf("load %s row %d: %w", fixture.Table, i, err)
+			}
+
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func read(dir string) (map[string]*Fixture, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	fixtures := map[string]*Fixture{}
+	for _, entry := range entries {
+		switch filepath.Ext(entry.Name()) {
+		case ".yml", ".yaml", ".json":
+		default:
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		fixture := new(Fixture)
+		// JSON is valid YAML, so one decoder reads both formats
+		if err := yaml.Unmarshal(content, fixture); err != nil {
+			return nil, fmt.Errorf("decode %s: %w", entry.Name(), err)
+		}
+
+		if fixture.Table == "" {
+			return nil, fmt.Errorf("decode %s: table is missing", entry.Name())
+		}
+
+		if existing, ok := fixtures[fixture.Table]; ok {
+			existing.Rows = append(existing.Rows, fixture.Rows...)
+			existing.DependsOn = append(existing.DependsOn, fixture.DependsOn...)
+			continue
+		}
+
+		fixtures[fixture.Table] = fixture
+	}
+
+	return fixtures, nil
+}
+
+// order sorts fixtures so that every table comes after the tables it depends on.
+func order(fixtures map[string]*Fixture) ([]*Fixture, error) {
+	tables := make([]string, 0, len(fixtures))
+	for table := range fixtures {
+		tables = append(tables, table)
+	}
+
+	sort.Strings(tables)
+
+	var (
+		ordered []*Fixture
+		visit   func(table string, path []string) error
+		state   = map[string]int{}
+	)
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+
+	visit = func(table string, path []string) error {
+		switch state[table] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("fixtures depend on each other: %s", strings.Join(append(path, table), " -> "))
+		}
+
+		fixture, ok := fixtures[table]
+		if !ok {
+			// the table has no fixtures in this set, for example a lookup table filled by a migration
+			state[table] = visited
+			return nil
+		}
+
+		state[table] = visiting
+		for _, dependency := range fixture.DependsOn {
+			if err := visit(dependency, append(path, table)); err != nil {
+				return err
+			}
+		}
+
+		state[table] = visited
+		ordered = append(ordered, fixture)
+
+		return nil
+	}
+
+	for _, table := range tables {
+		if err := visit(table, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return ordered, nil
+}
+
+func (l *loader) insert(ctx context.Context, tx *sqlx.Tx, table string, row map[string]interface{}) error {
+	name, _ := row[rowNameKey].(string)
+
+	columns := make([]string, 0, len(row))
+	for column := range row {
+		if column != rowNameKey {
+			columns = append(columns, column)
+		}
+	}
+
+	sort.Strings(columns)
+
+	placeholders := make([]string, 0, len(columns))
+	args := make([]interface{}, 0, len(columns))
+
+	for _, column := range columns {
+		value, err := l.render(row[column])
+		if err != nil {
+			return fmt.Errorf("column %s: %w", column, err)
+		}
+
+		args = append(args, value)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+	}
+
+	quoted := make([]string, 0, len(columns))
+	for _, column := range columns {
+		quoted = append(quoted, database.QuoteIdentifier(column))
+	}
+
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (%s)",
+		database.QuoteIdentifier(table),
+		strings.Join(quoted, ", "),
+		strings.Join(placeholders, ", "),
+	)
+
+	if name == "" {
+		_, err := tx.ExecContext(ctx, query, args...)
+		return err
+	}
+
+	// named rows are read back, so that rows loaded later can refer to the columns the database fills in
+	inserted := map[string]interface{}{}
+	if err := tx.QueryRowxContext(ctx, query+" RETURNING *", args...).MapScan(inserted); err != nil {
+		return err
+	}
+
+	for column, value := range inserted {
+		if raw, ok := value.([]byte); ok {
+			inserted[column] = string(raw)
+		}
+	}
+
+	l.rows[table+"."+name] = inserted
+
+	return nil
+}
+
+func (l *loader) render(value interface{}) (interface{}, error) {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		// nested values are stored in json or jsonb columns
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	}
+
+	text, ok := value.(string)
+	if !ok || !strings.Contains(text, "{{"{{"}}") {
+		return value, nil
+	}
+
+	tmpl, err := template.New("value").Funcs(l.funcs()).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, nil); err != nil {
+		return nil, err
+	}
+
+	return rendered.String(), nil
+}
+
+func (l *loader) funcs() template.FuncMap {
+	return template.FuncMap{
+		"now": func() string {
+			return l.now.Format(time.RFC3339Nano)
+		},
+		"offset": func(duration string) (string, error) {
+			d, err := time.ParseDuration(duration)
+			if err != nil {
+				return "", err
+			}
+
+			return l.now.Add(d).Format(time.RFC3339Nano), nil
+		},
+		"uuid": func() string {
+			return uuid.Must(uuid.NewV4()).String()
+		},
+		"seq": func(name string) int {
+			l.sequences[name]++
+			return l.sequences[name]
+		},
+		"ref": func(reference string) (interface{}, error) {
+			separator := strings.LastIndex(reference, ".")
+			if separator < 0 {
+				return nil, fmt.Errorf("reference %q is not <table>.<row name>.<column>", reference)
+			}
+
+			row, ok := l.rows[reference[:separator]]
+			if !ok {
+				return nil, fmt.Errorf("reference %q: no row named %s", reference, reference[:separator])
+			}
+
+			value, ok := row[reference[separator+1:]]
+			if !ok {
+				return nil, fmt.Errorf("reference %q: row has no column %s", reference, reference[separator+1:])
+			}
+
+			return value, nil
+		},
+	}
+}
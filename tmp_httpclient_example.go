@@ -39,6 +39,7 @@ func NewExampleClient(instrumentation *telemetry.Instrumentation) *ExampleClient
 
 	return &ExampleClient{
 		Client: newHTTPClient(
+			useCorrelationRoundTripper(),
 			useOTELRoundTripper(),
 			useMetricsRoundTripper(name, instrumentation.Registry()),
 			useLoggerRoundTripper(name, logger),
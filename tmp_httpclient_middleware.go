@@ -25,6 +25,11 @@ type (
 		logger *logging.Logger
 	}
 
+	// correlationRoundTripper forwards the correlation id and the request id of the request being served.
+	correlationRoundTripper struct {
+		next http.RoundTripper
+	}
+
 	roundTripperFunc func(client *http.Client)
 )
 
@@ -67,6 +72,16 @@ func useLoggerRoundTripper(name string, logger *logging.Logger) roundTripper {
 	})
 }
 
+// useCorrelationRoundTripper sets X-Correlation-ID and X-Request-ID on outgoing requests from the ids the API server
+// put in their context, unless they are set already.
+func useCorrelationRoundTripper() roundTripper {
+	return roundTripperFunc(func(client *http.Client) {
+		client.Transport = &correlationRoundTripper{
+			client.Transport,
+		}
+	})
+}
+
 func (fn roundTripperFunc) use(client *http.Client) {
 	fn(client)
 }
@@ -146,3 +161,28 @@ func (tripper *loggingRoundTripper) RoundTrip(request *http.Request) (*http.Resp
 
 	return response, err
 }
+
+func (tripper *correlationRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	headers := map[string]string{
+		logging.CorrelationIDHeader: logging.GetCorrelationIDFromCtx(request.Context()),
+		logging.RequestIDHeader:     logging.GetRequestIDFromCtx(request.Context()),
+	}
+
+	cloned := false
+
+	for header, id := range headers {
+		if id == "" || request.Header.Get(header) != "" {
+			continue
+		}
+
+		// a RoundTripper must not change the request it is given
+		if !cloned {
+			request = request.Clone(request.Context())
+			cloned = true
+		}
+
+		request.Header.Set(header, id)
+	}
+
+	return tripper.next.RoundTrip(request)
+}
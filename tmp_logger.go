@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"sync"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -22,6 +23,18 @@ type (
 
 const (
 	CorrelationID = ContextKey("correlationID")
+	RequestID     = ContextKey("requestID")
+
+	// CorrelationIDHeader carries the id that follows a request across services.
+	CorrelationIDHeader = "X-Correlation-ID"
+	// RequestIDHeader carries the id of a single request.
+	RequestIDHeader = "X-Request-ID"
+)
+
+var (
+	// level is shared by the loggers NewLogger returns, so that it can be changed while the service runs.
+	level     = zap.NewAtomicLevel()
+	levelOnce sync.Once
 )
 
 func GetCorrelationIDFromCtx(ctx context.Context) string {
@@ -38,32 +51,39 @@ func GetCorrelationIDFromCtx(ctx context.Context) string {
 	return id
 }
 
+// GetRequestIDFromCtx returns the request id set by the API server, or an empty string.
+func GetRequestIDFromCtx(ctx context.Context) string {
+	id, _ := ctx.Value(RequestID).(string)
+
+	return id
+}
+
 // NewLogger returns an instance of Logger.
 func NewLogger() *Logger {
 	logLevel := os.Getenv("LOG_LEVEL")
 
-	cfg := zap.NewProductionConfig()
-
-	cfg.OutputPaths = []string{"stdout"}
-	cfg.EncoderConfig.TimeKey = "timestamp"
-	cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
-	cfg.EncoderConfig.MessageKey = "message"
-	cfg.DisableCaller = true
-	cfg.DisableStacktrace = true
+	cfg := newConfig()
 
-	switch logLevel {
-	case "debug":
-		cfg.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
+	if logLevel == "debug" {
 		cfg.DisableCaller = false
 		cfg.DisableStacktrace = false
-	case "error":
-		cfg.Level = zap.NewAtomicLevelAt(zap.ErrorLevel)
-	case "warn":
-		cfg.Level = zap.NewAtomicLevelAt(zap.WarnLevel)
-	default:
-		cfg.Level = zap.NewAtomicLevelAt(zap.InfoLevel)
 	}
 
+	levelOnce.Do(func() {
+		switch logLevel {
+		case "debug":
+			level.SetLevel(zap.DebugLevel)
+		case "error":
+			level.SetLevel(zap.ErrorLevel)
+		case "warn":
+			level.SetLevel(zap.WarnLevel)
+		default:
+			level.SetLevel(zap.InfoLevel)
+		}
+	})
+
+	cfg.Level = level
+
 	l, err := cfg.Build()
 	if err != nil {
 		log.Fatalf("failed to load newLogger: %q", err)
@@ -72,6 +92,40 @@ func NewLogger() *Logger {
 	return &Logger{l}
 }
 
+// NewAuditLogger returns a Logger for security decisions. Its entries carry log_type=audit so that they can be
+// routed to their own stream, and they are written whatever LOG_LEVEL is set to.
+func NewAuditLogger() *Logger {
+	cfg := newConfig()
+	cfg.Level = zap.NewAtomicLevelAt(zap.InfoLevel)
+	cfg.InitialFields = map[string]interface{}{"log_type": "audit"}
+
+	l, err := cfg.Build()
+	if err != nil {
+		log.Fatalf("failed to load audit logger: %q", err)
+	}
+
+	return &Logger{l.Named("audit")}
+}
+
+// Level returns the level of the loggers NewLogger returns. It serves GET and PUT requests with a body such as
+// {"level":"debug"} to read and change it.
+func Level() zap.AtomicLevel {
+	return level
+}
+
+func newConfig() zap.Config {
+	cfg := zap.NewProductionConfig()
+
+	cfg.OutputPaths = []string{"stdout"}
+	cfg.EncoderConfig.TimeKey = "timestamp"
+	cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	cfg.EncoderConfig.MessageKey = "message"
+	cfg.DisableCaller = true
+	cfg.DisableStacktrace = true
+
+	return cfg
+}
+
 // CorrelationIDField returns a zap.Field with the correlation_id key.
 func CorrelationIDField(id string) zap.Field {
 	if id == "" {
@@ -81,6 +135,24 @@ func CorrelationIDField(id string) zap.Field {
 	return zap.String("correlation_id", id)
 }
 
+// RequestIDField returns a zap.Field with the request_id key.
+func RequestIDField(id string) zap.Field {
+	if id == "" {
+		return zap.Skip()
+	}
+
+	return zap.String("request_id", id)
+}
+
+// TenantField returns a zap.Field with the tenant key.
+func TenantField(id string) zap.Field {
+	if id == "" {
+		return zap.Skip()
+	}
+
+	return zap.String("tenant", id)
+}
+
 // SanitizeSecrets replaces sensitive information in the input string with "redacted". Add more patterns as needed.
 func SanitizeSecrets(input string) string {
 	secretPatterns := map[string]string{
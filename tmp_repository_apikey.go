@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	{{range .imports }}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// APIKeyRepository implements rest.APIKeyStore with the api_keys table, used when AUTH_API_KEY_BACKENDS lists
+	// postgres:
+	//
+	//	CREATE TABLE api_keys (
+	//	    id         text PRIMARY KEY,
+	//	    hash       text NOT NULL,
+	//	    scopes     text[] NOT NULL DEFAULT '{}',
+	//	    roles      text[] NOT NULL DEFAULT '{}',
+	//	    created_at timestamptz NOT NULL DEFAULT now(),
+	//	    revoked_at timestamptz
+	//	);
+	APIKeyRepository struct {
+		db *database.Connection
+	}
+
+	apiKeyRow struct {
+		ID        string         `db:"id"`
+		Hash      string         `db:"hash"`
+		Scopes    pq.StringArray `db:"scopes"`
+		Roles     pq.StringArray `db:"roles"`
+		CreatedAt time.Time      `db:"created_at"`
+	}
+)
+
+const apiKeyBackendPostgres = "postgres"
+
+// Backend implements rest.APIKeyStore.
+func (repository *APIKeyRepository) Backend() string {
+	return apiKeyBackendPostgres
+}
+
+// FindAPIKey implements rest.APIKeyStore. Revoked keys are not found.
+func (repository *APIKeyRepository) FindAPIKey(ctx context.Context, id string) (*rest.APIKey, error) {
+	var key apiKeyRow
+
+	err := repository.db.GetContext(
+		ctx,
+		&key,
+		`SELECT id, hash, scopes, roles, created_at FROM api_keys WHERE id = $1 AND revoked_at IS NULL`,
+		id,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, rest.ErrAPIKeyNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &rest.APIKey{
+		ID:     key.ID,
+		Hash:   key.Hash,
+		Scopes: key.Scopes,
+		Roles:  key.Roles,
+	}, nil
+}
@@ -8,9 +8,25 @@ import (
 
 // NewRepository returns an instance of Repository.
 // NewRepository is an example of a factory function.
-// Use this as an example to create your own repository factory functions
+// Use this as an example to create your own repository factory functions.
+// A repository backed by a named database takes *database.Connections instead and picks its connection with
+// connections.Named("analytics"), where analytics is listed in DATABASE_CONNECTIONS.
 func NewRepository(connection *database.Connection) *Repository {
 	return &Repository{
 		db: connection,
 	}
 }
+
+// NewAPIKeyRepository returns an instance of APIKeyRepository.
+func NewAPIKeyRepository(connection *database.Connection) *APIKeyRepository {
+	return &APIKeyRepository{
+		db: connection,
+	}
+}
+
+// NewIdempotencyRepository returns an instance of IdempotencyRepository.
+func NewIdempotencyRepository(connection *database.Connection) *IdempotencyRepository {
+	return &IdempotencyRepository{
+		db: connection,
+	}
+}
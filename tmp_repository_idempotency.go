@@ -0,0 +1,139 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+	{{range .imports }}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// IdempotencyRepository implements rest.IdempotencyStore with the idempotency_keys table. Expired rows are
+	// taken over by the next request with their key; delete them from time to time with
+	// DELETE FROM idempotency_keys WHERE expires_at <= now().
+	//
+	//	CREATE TABLE idempotency_keys (
+	//	    key         text PRIMARY KEY,
+	//	    fingerprint text NOT NULL,
+	//	    status      integer,
+	//	    header      jsonb,
+	//	    body        bytea,
+	//	    expires_at  timestamptz NOT NULL
+	//	);
+	IdempotencyRepository struct {
+		db *database.Connection
+	}
+
+	idempotencyRow struct {
+		Fingerprint string        `db:"fingerprint"`
+		Status      sql.NullInt64 `db:"status"`
+		Header      []byte        `db:"header"`
+		Body        []byte        `db:"body"`
+	}
+)
+
+const idempotencyBackendPostgres = "postgres"
+
+// Backend implements rest.IdempotencyStore.
+func (repository *IdempotencyRepository) Backend() string {
+	return idempotencyBackendPostgres
+}
+
+// Begin implements rest.IdempotencyStore.
+func (repository *IdempotencyRepository) Begin(
+	ctx context.Context,
+	key, fingerprint string,
+	lockTimeout time.Duration,
+) (*rest.IdempotencyRecord, error) {
+	result, err := repository.db.ExecContext(
+		ctx,
+		`INSERT INTO idempotency_keys (key, fingerprint, expires_at)
+		VALUES ($1, $2, now() + make_interval(secs => $3))
+		ON CONFLICT (key) DO UPDATE
+		SET fingerprint = EXCLUDED.fingerprint, status = NULL, header = NULL, body = NULL,
+			expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= now()`,
+		key,
+		fingerprint,
+		lockTimeout.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if rows, err := result.RowsAffected(); err != nil || rows == 1 {
+		return nil, err
+	}
+
+	var row idempotencyRow
+
+	err = repository.db.GetContext(
+		ctx,
+		&row,
+		`SELECT fingerprint, status, header, body FROM idempotency_keys WHERE key = $1`,
+		key,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		// the request holding the key released it in the meantime
+		return repository.Begin(ctx, key, fingerprint, lockTimeout)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	record := &rest.IdempotencyRecord{
+		Fingerprint: row.Fingerprint,
+		Status:      int(row.Status.Int64),
+		Body:        row.Body,
+	}
+
+	if len(row.Header) > 0 {
+		if err := json.Unmarshal(row.Header, &record.Header); err != nil {
+			return nil, err
+		}
+	}
+
+	return record, nil
+}
+
+// Complete implements rest.IdempotencyStore.
+func (repository *IdempotencyRepository) Complete(
+	ctx context.Context,
+	key string,
+	record *rest.IdempotencyRecord,
+	ttl time.Duration,
+) error {
+	header, err := json.Marshal(record.Header)
+	if err != nil {
+		return err
+	}
+
+	_, err = repository.db.ExecContext(
+		ctx,
+		`INSERT INTO idempotency_keys (key, fingerprint, status, header, body, expires_at)
+		VALUES ($1, $2, $3, $4, $5, now() + make_interval(secs => $6))
+		ON CONFLICT (key) DO UPDATE
+		SET fingerprint = EXCLUDED.fingerprint, status = EXCLUDED.status, header = EXCLUDED.header,
+			body = EXCLUDED.body, expires_at = EXCLUDED.expires_at`,
+		key,
+		record.Fingerprint,
+		record.Status,
+		header,
+		record.Body,
+		ttl.Seconds(),
+	)
+
+	return err
+}
+
+// Release implements rest.IdempotencyStore.
+func (repository *IdempotencyRepository) Release(ctx context.Context, key string) error {
+	_, err := repository.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE key = $1`, key)
+
+	return err
+}
@@ -0,0 +1,157 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime/debug"
+
+	"github.com/go-chi/chi"
+	chiMiddleware "github.com/go-chi/chi/middleware"
+	"github.com/nicklaw5/go-respond"
+	"go.uber.org/zap"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// adminServer serves the operational endpoints of the service on their own address, away from API clients:
+	// metrics, health probes, pprof, the log level and build info.
+	adminServer struct {
+		*http.Server
+
+		router *chi.Mux
+		config *adminConfig
+		log    *logging.Logger
+	}
+
+	buildInfo struct {
+		GoVersion string `json:"go_version"`
+		Path      string `json:"path"`
+		Version   string `json:"version"`
+		Revision  string `json:"revision,omitempty"`
+		Time      string `json:"time,omitempty"`
+		Modified  bool   `json:"modified"`
+	}
+)
+
+const adminRealm = "admin"
+
+func newAdminServer(cfg *adminConfig, httpCfg *httpConfig, logger *logging.Logger) *adminServer {
+	if cfg.PprofEnabled && !cfg.authenticated() {
+		log.Fatalf("failed to configure admin server: ADMIN_PPROF_ENABLED needs ADMIN_USERNAME and ADMIN_PASSWORD")
+	}
+
+	router := chi.NewMux()
+
+	return &adminServer{
+		Server: &http.Server{
+			Addr:              cfg.Address,
+			Handler:           router,
+			ReadHeaderTimeout: httpCfg.ReadHeaderTimeout,
+			IdleTimeout:       httpCfg.IdleTimeout,
+		},
+		router: router,
+		config: cfg,
+		log:    logger,
+	}
+}
+
+// authenticated reports whether the admin endpoints are put behind basic auth.
+func (cfg *adminConfig) authenticated() bool {
+	return cfg.Username != "" && cfg.Password != ""
+}
+
+// registerAdminEndpoints mounts the operational endpoints on the admin server. All but the health probes are put
+// behind basic auth when ADMIN_USERNAME and ADMIN_PASSWORD are set; without them the log level cannot be changed
+// and pprof is refused. /readyz fails once the API server shuts down; /status stays available next to it for
+// existing probes.
+func registerAdminEndpoints(server *APIServer, endpoints []Endpoint) {
+	admin := server.admin
+
+	admin.router.NotFound(serverNotFoundHandler)
+	admin.router.MethodNotAllowed(serverMethodNotAllowedHandler)
+	admin.router.Use(serverRecoveryMiddleware(nil, admin.log))
+
+	admin.router.Get("/livez", func(w http.ResponseWriter, r *http.Request) {
+		respond.NewResponse(w).Ok(serverResponse{"status": "up"})
+	})
+
+	for _, endpoint := range endpoints {
+		if status, ok := endpoint.(*StatusEndpoint); ok {
+			admin.router.Get("/readyz", server.readiness(status.Handler()))
+			admin.router.Get("/status", server.readiness(status.Handler()))
+		}
+	}
+
+	admin.router.Group(func(r chi.Router) {
+		if admin.config.authenticated() {
+			r.Use(chiMiddleware.BasicAuth(adminRealm, map[string]string{
+				admin.config.Username: admin.config.Password,
+			}))
+		}
+
+		r.Handle("/metrics", server.instrumentation.Endpoint())
+		r.Method(http.MethodGet, "/log-level", logging.Level())
+
+		if admin.config.authenticated() {
+			r.Method(http.MethodPut, "/log-level", logging.Level())
+		}
+
+		r.Get("/buildinfo", serveBuildInfo)
+
+		if admin.config.PprofEnabled {
+			r.HandleFunc("/debug/pprof/*", pprof.Index)
+			r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+			r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+			r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+			r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		}
+	})
+}
+
+func serveBuildInfo(w http.ResponseWriter, r *http.Request) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		writeProblem(w, r, NewProblem(http.StatusNotFound, "the binary was built without module support"))
+		return
+	}
+
+	build := buildInfo{GoVersion: info.GoVersion, Path: info.Main.Path, Version: info.Main.Version}
+
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			build.Revision = setting.Value
+		case "vcs.time":
+			build.Time = setting.Value
+		case "vcs.modified":
+			build.Modified = setting.Value == "true"
+		}
+	}
+
+	writeJSON(w, http.StatusOK, build)
+}
+
+// serve listens on ADMIN_SERVER_ADDRESS until the admin server is shut down.
+func (admin *adminServer) serve(serverErr chan<- error) {
+	admin.log.Debug(fmt.Sprintf("starting admin server on %s", admin.Addr))
+
+	if err := admin.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		serverErr <- fmt.Errorf("admin server: %w", err)
+	}
+}
+
+// shutdown stops the admin server. It is shut down after the API server so that metrics and probes stay
+// available while API requests drain.
+func (admin *adminServer) shutdown(ctx context.Context) {
+	admin.log.Info("shutting down admin server")
+
+	if err := admin.Shutdown(ctx); err != nil {
+		admin.log.Error("admin server shutdown did not complete successfully", zap.Error(err))
+	}
+}
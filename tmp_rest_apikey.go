@@ -0,0 +1,170 @@
+package rest
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// APIKey is a static credential given to a partner integration. Callers send "<id>.<secret>" in the API key
+	// header; only the SHA-256 hash of the secret is stored, as returned by HashAPIKeySecret or
+	// `printf '%s' "$secret" | sha256sum`.
+	APIKey struct {
+		ID     string   `yaml:"id"`
+		Hash   string   `yaml:"hash"`
+		Scopes []string `yaml:"scopes"`
+		Roles  []string `yaml:"roles"`
+	}
+
+	// ConfigAPIKeyStore holds the API keys listed in AUTH_API_KEYS_FILE, for example:
+	//
+	//	- id: acme
+	//	  hash: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+	//	  scopes: [example:read]
+	//	  roles: [partner]
+	ConfigAPIKeyStore struct {
+		keys map[string]*APIKey
+	}
+)
+
+const (
+	apiKeyDivider = "."
+
+	apiKeyBackendConfig = "config"
+
+	authMethodAPIKey = "api_key"
+
+	authReasonInvalidAPIKey       = "invalid_api_key"
+	authReasonKeyStoreUnavailable = "key_store_unavailable"
+)
+
+// ErrAPIKeyNotFound is returned by an APIKeyStore that does not hold a key with the requested id.
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// HashAPIKeySecret returns the hex encoded SHA-256 hash of secret, which is what API key stores hold.
+func HashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Backend implements APIKeyStore.
+func (store *ConfigAPIKeyStore) Backend() string {
+	return apiKeyBackendConfig
+}
+
+// FindAPIKey implements APIKeyStore.
+func (store *ConfigAPIKeyStore) FindAPIKey(_ context.Context, id string) (*APIKey, error) {
+	key, ok := store.keys[id]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	return key, nil
+}
+
+// apiKeyStores returns the stores of stores that serve the backends of AUTH_API_KEY_BACKENDS, in that order.
+func apiKeyStores(cfg *authConfig, stores []APIKeyStore) []APIKeyStore {
+	backends := cfg.APIKeyBackends
+	if len(backends) == 0 && cfg.APIKeysFile != "" {
+		backends = []string{apiKeyBackendConfig}
+	}
+
+	selected := make([]APIKeyStore, 0, len(backends))
+
+	for _, backend := range backends {
+		index := slices.IndexFunc(stores, func(store APIKeyStore) bool { return store.Backend() == backend })
+		if index < 0 {
+			log.Fatalf("failed to create api key store: no store for backend %q", backend)
+		}
+
+		selected = append(selected, stores[index])
+	}
+
+	return selected
+}
+
+func readAPIKeysFile(path string) (map[string]*APIKey, error) {
+	keys := map[string]*APIKey{}
+	if path == "" {
+		return keys, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*APIKey
+	if err := yaml.Unmarshal(content, &list); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+
+	for _, key := range list {
+		if key.ID == "" || strings.Contains(key.ID, apiKeyDivider) {
+			return nil, fmt.Errorf("decode %s: invalid api key id %q", path, key.ID)
+		}
+
+		if _, err := hex.DecodeString(key.Hash); err != nil || len(key.Hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("decode %s: api key %s hash is not a hex encoded SHA-256 hash", path, key.ID)
+		}
+
+		keys[key.ID] = key
+	}
+
+	return keys, nil
+}
+
+// authenticateAPIKey looks the key id up in every store in turn, so keys can live in config and in the database.
+func (auth *authenticator) authenticateAPIKey(ctx context.Context, presented string) (*Principal, *authFailure) {
+	id, secret, ok := strings.Cut(strings.TrimSpace(presented), apiKeyDivider)
+	if !ok || id == "" || secret == "" {
+		return nil, newAPIKeyFailure(authReasonMalformed, "")
+	}
+
+	for _, store := range auth.keyStores {
+		key, err := store.FindAPIKey(ctx, id)
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			continue
+		}
+
+		if err != nil {
+			failure := newAPIKeyFailure(authReasonKeyStoreUnavailable, id)
+			failure.err = err
+
+			return nil, failure
+		}
+
+		hash := HashAPIKeySecret(secret)
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(strings.ToLower(key.Hash))) != 1 {
+			return nil, newAPIKeyFailure(authReasonInvalidAPIKey, id)
+		}
+
+		return &Principal{
+			Subject: key.ID,
+			KeyID:   key.ID,
+			Method:  authMethodAPIKey,
+			Scopes:  key.Scopes,
+			Roles:   key.Roles,
+		}, nil
+	}
+
+	return nil, newAPIKeyFailure(authReasonUnknownKey, id)
+}
+
+func newAPIKeyFailure(reason, keyID string) *authFailure {
+	return &authFailure{
+		reason:      reason,
+		description: strings.ReplaceAll(reason, "_", " "),
+		keyID:       keyID,
+	}
+}
@@ -0,0 +1,302 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// Principal is the authenticated caller of a request.
+	Principal struct {
+		Subject string
+		Issuer  string
+		Method  string
+		// KeyID is the id of the API key the caller used, it is empty for other methods.
+		KeyID  string
+		Scopes []string
+		Roles  []string
+		Claims map[string]interface{}
+	}
+
+	// Authorization lists what a caller needs to use an endpoint: every scope in Scopes and, when Roles is not
+	// empty, at least one of Roles.
+	Authorization struct {
+		Scopes []string
+		Roles  []string
+	}
+
+	authenticator struct {
+		config    *authConfig
+		parser    *jwt.Parser
+		keys      *keySet
+		keyStores []APIKeyStore
+	}
+
+	// authFailure is why a request was not authenticated. Reason is used as a metric label and in the
+	// WWW-Authenticate header, so it must come from a small fixed set of values.
+	authFailure struct {
+		reason      string
+		description string
+		keyID       string
+		err         error
+	}
+)
+
+const (
+	authMethodJWT = "jwt"
+
+	rejectedByAuth          = "auth"
+	rejectedByAuthorization = "authorization"
+
+	authReasonMissingToken     = "missing_token"
+	authReasonMalformed        = "malformed"
+	authReasonExpired          = "expired"
+	authReasonNotYetValid      = "not_yet_valid"
+	authReasonInvalidIssuer    = "invalid_issuer"
+	authReasonInvalidAudience  = "invalid_audience"
+	authReasonMissingClaim     = "missing_claim"
+	authReasonUnknownKey       = "unknown_key"
+	authReasonInvalidSignature = "invalid_signature"
+	authReasonInvalidToken     = "invalid_token"
+
+	authReasonMissingScope = "missing_scope"
+	authReasonMissingRole  = "missing_role"
+
+	bearerPrefix = "bearer "
+)
+
+// PrincipalFromContext returns the principal the auth middleware stored in ctx.
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(apiPrincipal).(*Principal)
+	return principal, ok
+}
+
+// HasScope reports whether the principal was granted scope.
+func (p *Principal) HasScope(scope string) bool {
+	return contains(p.Scopes, scope)
+}
+
+// HasRole reports whether the principal holds role.
+func (p *Principal) HasRole(role string) bool {
+	return contains(p.Roles, role)
+}
+
+// check returns the reason principal may not use an endpoint requiring authorization, or an empty string.
+func (authorization Authorization) check(principal *Principal) string {
+	for _, scope := range authorization.Scopes {
+		if !principal.HasScope(scope) {
+			return authReasonMissingScope
+		}
+	}
+
+	if len(authorization.Roles) == 0 {
+		return ""
+	}
+
+	for _, role := range authorization.Roles {
+		if principal.HasRole(role) {
+			return ""
+		}
+	}
+
+	return authReasonMissingRole
+}
+
+func newAuthenticator(
+	cfg *authConfig,
+	tlsCfg *tlsConfig,
+	keyStores []APIKeyStore,
+	logger *logging.Logger,
+) *authenticator {
+	keys, err := newKeySet(cfg, logger)
+	if err != nil {
+		log.Fatalf("failed to load JWT verification keys: %q", err)
+	}
+
+	keyStores = apiKeyStores(cfg, keyStores)
+
+	if !cfg.Disabled && cfg.JWTHMACSecret == "" && keys.empty() && len(keyStores) == 0 && !tlsCfg.verifiesClients() {
+		log.Fatalf("no JWT verification keys, API key stores or client certificate verification configured, set " +
+			"AUTH_JWT_HMAC_SECRET, AUTH_JWT_PUBLIC_KEY_FILE, AUTH_JWKS_FILE, AUTH_JWKS_URL, AUTH_API_KEYS_FILE, " +
+			"AUTH_API_KEY_BACKENDS or TLS_CLIENT_AUTH, or set AUTH_DISABLED=true")
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(cfg.JWTAlgorithms),
+		jwt.WithLeeway(cfg.JWTClockSkew),
+		jwt.WithExpirationRequired(),
+	}
+
+	if cfg.JWTIssuer != "" {
+		options = append(options, jwt.WithIssuer(cfg.JWTIssuer))
+	}
+
+	if cfg.JWTAudience != "" {
+		options = append(options, jwt.WithAudience(cfg.JWTAudience))
+	}
+
+	return &authenticator{
+		config:    cfg,
+		parser:    jwt.NewParser(options...),
+		keys:      keys,
+		keyStores: keyStores,
+	}
+}
+
+// authenticate reads the credentials of r: an API key, else a bearer token, else a verified client certificate.
+func (auth *authenticator) authenticate(r *http.Request) (*Principal, *authFailure) {
+	if key := r.Header.Get(auth.config.APIKeyHeader); key != "" {
+		return auth.authenticateAPIKey(r.Context(), key)
+	}
+
+	header := r.Header.Get("Authorization")
+	if len(header) < len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		if principal, ok := clientCertificatePrincipal(r); ok {
+			return principal, nil
+		}
+
+		return nil, &authFailure{reason: authReasonMissingToken, description: "bearer token is missing"}
+	}
+
+	claims := jwt.MapClaims{}
+
+	_, err := auth.parser.ParseWithClaims(
+		strings.TrimSpace(header[len(bearerPrefix):]),
+		claims,
+		auth.keyFunc(r.Context()),
+	)
+	if err != nil {
+		return nil, newAuthFailure(err)
+	}
+
+	subject, _ := claims.GetSubject()
+	issuer, _ := claims.GetIssuer()
+
+	return &Principal{
+		Subject: subject,
+		Issuer:  issuer,
+		Method:  authMethodJWT,
+		Scopes:  scopesFromClaims(claims),
+		Roles:   stringsFromClaim(claims, "roles"),
+		Claims:  claims,
+	}, nil
+}
+
+// keyFunc only hands out the HMAC secret for HS* tokens and public keys for RS* and ES* tokens, so a token cannot
+// pick an algorithm that makes a public key usable as a shared secret.
+func (auth *authenticator) keyFunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodHMAC:
+			if auth.config.JWTHMACSecret == "" {
+				return nil, errUnknownKey
+			}
+
+			return []byte(auth.config.JWTHMACSecret), nil
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+			kid, _ := token.Header["kid"].(string)
+			return auth.keys.lookup(ctx, kid)
+		default:
+			return nil, errUnknownKey
+		}
+	}
+}
+
+// status returns the response status code for failure.
+func (failure *authFailure) status() int {
+	if failure.reason == authReasonKeyStoreUnavailable {
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusUnauthorized
+}
+
+// challenge returns the WWW-Authenticate header value described in RFC 6750.
+func (auth *authenticator) challenge(failure *authFailure) string {
+	if failure.reason == authReasonMissingToken {
+		return fmt.Sprintf(`Bearer realm=%q`, auth.config.Realm)
+	}
+
+	return fmt.Sprintf(
+		`Bearer realm=%q, error="invalid_token", error_description=%q`,
+		auth.config.Realm,
+		failure.description,
+	)
+}
+
+func newAuthFailure(err error) *authFailure {
+	var reason string
+
+	switch {
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		reason = authReasonMalformed
+	case errors.Is(err, jwt.ErrTokenExpired):
+		reason = authReasonExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		reason = authReasonNotYetValid
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		reason = authReasonInvalidIssuer
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		reason = authReasonInvalidAudience
+	case errors.Is(err, jwt.ErrTokenRequiredClaimMissing):
+		reason = authReasonMissingClaim
+	case errors.Is(err, errUnknownKey):
+		reason = authReasonUnknownKey
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		reason = authReasonInvalidSignature
+	default:
+		reason = authReasonInvalidToken
+	}
+
+	return &authFailure{reason: reason, description: strings.ReplaceAll(reason, "_", " ")}
+}
+
+// scopesFromClaims reads the space separated scope claim, or the scp array some identity providers use instead.
+func scopesFromClaims(claims jwt.MapClaims) []string {
+	if scope, ok := claims["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+
+	return stringsFromClaim(claims, "scp")
+}
+
+func stringsFromClaim(claims jwt.MapClaims, name string) []string {
+	values, _ := claims[name].([]interface{})
+
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		if str, ok := value.(string); ok {
+			strs = append(strs, str)
+		}
+	}
+
+	return strs
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func principalSpanAttributes(ctx context.Context, principal *Principal) {
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("enduser.id", principal.Subject),
+		attribute.String("enduser.auth_method", principal.Method),
+	)
+}
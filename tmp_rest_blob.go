@@ -0,0 +1,495 @@
+package rest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"go.uber.org/zap"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// UploadOptions limit the files HandleUpload accepts. Zero values mean no limit.
+	UploadOptions struct {
+		MaxFileBytes int64
+		MaxFiles     int
+		// AllowedContentTypes are media types such as application/pdf, or image/* for all images.
+		AllowedContentTypes []string
+		// Key returns the key a file is stored under, a random UUID by default.
+		Key func(r *http.Request, field, filename string) (string, error)
+	}
+
+	// Upload holds the files of a multipart upload, stored in the order they were sent, and its other form fields.
+	Upload struct {
+		Files  []UploadedFile
+		Fields url.Values
+	}
+
+	// UploadedFile is a file of an Upload, Checksum is the hex encoded SHA-256 of its content.
+	UploadedFile struct {
+		storage.BlobInfo
+
+		Field    string `json:"field"`
+		Filename string `json:"filename"`
+	}
+
+	// fileLimitReader fails reads once more than max bytes were read.
+	fileLimitReader struct {
+		reader io.Reader
+		max    int64
+		read   int64
+	}
+)
+
+const (
+	// sniffLen is how many bytes http.DetectContentType looks at.
+	sniffLen = 512
+
+	// maxFieldBytes caps the value of the form fields of an upload, they are held in memory.
+	maxFieldBytes = 64 << 10
+
+	multipartFormData = "multipart/form-data"
+
+	// maxDownloadAttempts bounds how often a download starts over on a blob replaced while it was being opened.
+	maxDownloadAttempts = 3
+)
+
+var errFileTooLarge = errors.New("file is too large")
+
+// HandleUpload adapts fn to an http.HandlerFunc that streams the files of a multipart/form-data request into store
+// as they arrive, without buffering them in memory or on disk. The content type of a file is sniffed from its
+// first 512 bytes; the type the client declares is ignored. Files larger than MaxFileBytes are answered with
+// 413 Request Entity Too Large and files of other types than AllowedContentTypes with 415 Unsupported Media Type.
+// The files stored are deleted when the request fails or fn returns an error.
+//
+// Uploads are bounded by the body size cap and the request timeout of their route, lift them with
+// HTTP_ROUTE_LIMITS, for example "/documents:0s/104857600". HTTP_READ_TIMEOUT is lifted for the request.
+//
+//	func (handler *DocumentsEndpoint) Handler() http.HandlerFunc {
+//		return HandleUpload(handler.log, handler.store, UploadOptions{
+//			MaxFileBytes:        10 << 20,
+//			MaxFiles:            1,
+//			AllowedContentTypes: []string{"application/pdf"},
+//		}, func(ctx context.Context, upload *Upload) (*createdDocument, error) {
+//			return handler.documents.Create(ctx, upload.Fields.Get("title"), upload.Files[0])
+//		})
+//	}
+func HandleUpload[Resp any](
+	log *logging.Logger,
+	store storage.BlobStore,
+	opts UploadOptions,
+	fn func(ctx context.Context, upload *Upload) (Resp, error),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = http.NewResponseController(w).SetReadDeadline(time.Time{})
+
+		upload, err := receiveUpload(r, store, opts)
+		if err != nil {
+			deleteUpload(r, log, store, upload)
+			writeError(w, r, log, err)
+
+			return
+		}
+
+		resp, err := fn(r.Context(), upload)
+		if err != nil {
+			deleteUpload(r, log, store, upload)
+			writeError(w, r, log, err)
+
+			return
+		}
+
+		status := http.StatusCreated
+		if coder, ok := any(resp).(StatusCoder); ok {
+			status = coder.StatusCode()
+		}
+
+		if status == http.StatusNoContent {
+			w.WriteHeader(status)
+			return
+		}
+
+		writeJSON(w, status, resp)
+	}
+}
+
+// HandleDownload returns an http.HandlerFunc that sends the blob under the key returned by key. It answers
+// conditional requests with If-None-Match with 304 Not Modified and serves a single byte range, honouring If-Range,
+// with 206 Partial Content; requests for several ranges get the whole blob. HEAD requests get the headers only.
+//
+// Downloads are bounded by the request timeout of their route, lift it with HTTP_ROUTE_LIMITS for large blobs.
+// HTTP_WRITE_TIMEOUT is lifted for the response.
+func HandleDownload(
+	log *logging.Logger,
+	store storage.BlobStore,
+	key func(r *http.Request) (string, error),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		blobKey, err := key(r)
+		if err != nil {
+			writeError(w, r, log, err)
+			return
+		}
+
+		info, err := store.Stat(r.Context(), blobKey)
+		if err != nil {
+			writeError(w, r, log, storageError(err))
+			return
+		}
+
+		// the range is decided on info; when another Put replaces the blob before Get, it is decided again on the
+		// blob read, so that the validators sent describe the bytes sent
+		for attempt := 1; ; attempt++ {
+			w.Header().Set("ETag", info.ETag)
+			w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+			w.Header().Set("Accept-Ranges", "bytes")
+
+			if etagMatches(r.Header.Get("If-None-Match"), info.ETag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+			rng, err := requestedRange(r, info)
+			if err != nil {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+				writeError(w, r, log, storageError(err))
+
+				return
+			}
+
+			blob, err := store.Get(r.Context(), blobKey, rng)
+			if err != nil {
+				writeError(w, r, log, storageError(err))
+				return
+			}
+
+			if blob.Info.ETag == info.ETag {
+				sendBlob(w, r, log, blob)
+				return
+			}
+
+			_ = blob.Close()
+
+			if attempt == maxDownloadAttempts {
+				writeError(w, r, log, NewError(http.StatusServiceUnavailable, "file is being replaced, try again", nil))
+				return
+			}
+
+			info = &blob.Info
+		}
+	}
+}
+
+// sendBlob sends blob, the part of it only when it is a range.
+func sendBlob(w http.ResponseWriter, r *http.Request, log *logging.Logger, blob *storage.Blob) {
+	defer func() { _ = blob.Close() }()
+
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	status, length := http.StatusOK, blob.Info.Size
+	if blob.Range != nil {
+		status, length = http.StatusPartialContent, blob.Range.Length
+		w.Header().Set(
+			"Content-Range",
+			fmt.Sprintf("bytes %d-%d/%d", blob.Range.Offset, blob.Range.Offset+length-1, blob.Info.Size),
+		)
+	}
+
+	w.Header().Set("Content-Type", blob.Info.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if _, err := io.Copy(w, blob); err != nil && r.Context().Err() == nil {
+		log.Info(
+			"failed to send blob",
+			zap.String("http_url", r.URL.Path),
+			zap.String("blob_key", blob.Info.Key),
+			zap.Error(err),
+		)
+	}
+}
+
+// receiveUpload stores the files of r as they are read. The upload returned holds the files stored so far, also
+// when receiving fails.
+func receiveUpload(r *http.Request, store storage.BlobStore, opts UploadOptions) (*Upload, error) {
+	upload := &Upload{Fields: url.Values{}}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return upload, NewError(
+			http.StatusUnsupportedMediaType,
+			fmt.Sprintf("request body must be %s", multipartFormData),
+			err,
+		)
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return upload, nil
+		}
+
+		if err != nil {
+			return upload, uploadError(err)
+		}
+
+		if part.FileName() == "" {
+			if err := receiveField(part.FormName(), part, upload); err != nil {
+				return upload, err
+			}
+
+			continue
+		}
+
+		if opts.MaxFiles > 0 && len(upload.Files) == opts.MaxFiles {
+			return upload, NewError(
+				http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("uploads are limited to %d files", opts.MaxFiles),
+				nil,
+			)
+		}
+
+		file, err := receiveFile(r, store, opts, part.FormName(), part.FileName(), part)
+		if err != nil {
+			return upload, err
+		}
+
+		upload.Files = append(upload.Files, *file)
+	}
+}
+
+func receiveField(name string, part io.Reader, upload *Upload) error {
+	value, err := io.ReadAll(io.LimitReader(part, maxFieldBytes+1))
+	if err != nil {
+		return uploadError(err)
+	}
+
+	if len(value) > maxFieldBytes {
+		return NewError(
+			http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("form field %s is larger than %d bytes", name, maxFieldBytes),
+			nil,
+		)
+	}
+
+	upload.Fields.Add(name, string(value))
+
+	return nil
+}
+
+func receiveFile(
+	r *http.Request,
+	store storage.BlobStore,
+	opts UploadOptions,
+	field, filename string,
+	part io.Reader,
+) (*UploadedFile, error) {
+	buffered := bufio.NewReaderSize(part, sniffLen)
+
+	head, err := buffered.Peek(sniffLen)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, uploadError(err)
+	}
+
+	contentType := http.DetectContentType(head)
+	if !contentTypeAllowed(contentType, opts.AllowedContentTypes) {
+		return nil, NewError(
+			http.StatusUnsupportedMediaType,
+			fmt.Sprintf("%s is not an accepted file type", filename),
+			nil,
+		)
+	}
+
+	key := uuid.Must(uuid.NewV4()).String()
+	if opts.Key != nil {
+		if key, err = opts.Key(r, field, filename); err != nil {
+			return nil, err
+		}
+	}
+
+	var body io.Reader = buffered
+	if opts.MaxFileBytes > 0 {
+		body = &fileLimitReader{reader: buffered, max: opts.MaxFileBytes}
+	}
+
+	info, err := store.Put(r.Context(), key, body, storage.PutOptions{ContentType: contentType, Size: -1})
+	if errors.Is(err, errFileTooLarge) {
+		return nil, NewError(
+			http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("files are limited to %d bytes", opts.MaxFileBytes),
+			err,
+		)
+	}
+
+	if err != nil {
+		return nil, uploadError(storageError(err))
+	}
+
+	return &UploadedFile{BlobInfo: *info, Field: field, Filename: filename}, nil
+}
+
+// deleteUpload deletes the files of a failed upload.
+func deleteUpload(r *http.Request, log *logging.Logger, store storage.BlobStore, upload *Upload) {
+	if upload == nil {
+		return
+	}
+
+	ctx := context.WithoutCancel(r.Context())
+
+	for _, file := range upload.Files {
+		if err := store.Delete(ctx, file.Key); err != nil {
+			log.Error(
+				"failed to delete file of failed upload",
+				zap.String("http_url", r.URL.Path),
+				zap.String("blob_key", file.Key),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// Read implements io.Reader.
+func (reader *fileLimitReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.read += int64(n)
+
+	if reader.read > reader.max {
+		return n, errFileTooLarge
+	}
+
+	return n, err
+}
+
+// requestedRange returns the byte range r asks for, or nil for the whole blob.
+func requestedRange(r *http.Request, info *storage.BlobInfo) (*storage.Range, error) {
+	header := r.Header.Get("Range")
+	if header == "" || r.Method != http.MethodGet {
+		return nil, nil
+	}
+
+	// If-Range holds the ETag the client has the other parts of, send the whole blob when it changed since
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != info.ETag {
+		return nil, nil
+	}
+
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return nil, nil
+	}
+
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return nil, nil
+	}
+
+	if first == "" {
+		// bytes=-<n> asks for the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil {
+			return nil, nil
+		}
+
+		if n <= 0 || info.Size == 0 {
+			return nil, storage.ErrInvalidRange
+		}
+
+		n = min(n, info.Size)
+
+		return &storage.Range{Offset: info.Size - n, Length: n}, nil
+	}
+
+	offset, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || offset < 0 {
+		return nil, nil
+	}
+
+	if offset >= info.Size {
+		return nil, storage.ErrInvalidRange
+	}
+
+	end := info.Size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < offset {
+			return nil, nil
+		}
+	}
+
+	return &storage.Range{Offset: offset, Length: min(end, info.Size-1) - offset + 1}, nil
+}
+
+func contentTypeAllowed(contentType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	for _, pattern := range allowed {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+
+			continue
+		}
+
+		if mediaType == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// storageError maps the errors of the storage package to the status they are answered with.
+func storageError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return NewError(http.StatusNotFound, "file not found", err)
+	case errors.Is(err, storage.ErrInvalidKey):
+		return NewError(http.StatusBadRequest, "invalid file name", err)
+	case errors.Is(err, storage.ErrInvalidRange):
+		return NewError(http.StatusRequestedRangeNotSatisfiable, "range not satisfiable", err)
+	}
+
+	return err
+}
+
+// uploadError maps the errors of reading a multipart body to the status they are answered with.
+func uploadError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return NewError(
+			http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("request body is larger than %d bytes", maxBytesErr.Limit),
+			err,
+		)
+	}
+
+	var apiErr *Error
+	if errors.As(err, &apiErr) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	if strings.HasPrefix(err.Error(), "multipart:") || errors.Is(err, io.ErrUnexpectedEOF) {
+		return NewError(http.StatusBadRequest, "malformed multipart body", err)
+	}
+
+	return err
+}
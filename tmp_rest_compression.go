@@ -0,0 +1,393 @@
+package rest
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// encoder is a content coding writer that can be reused for another response with Reset.
+	encoder interface {
+		io.WriteCloser
+		Flush() error
+		Reset(w io.Writer)
+	}
+
+	// compressor encodes responses with one content coding, reusing its encoders.
+	compressor struct {
+		name string
+		pool sync.Pool
+	}
+
+	// compression negotiates the content coding of responses and encodes them.
+	compression struct {
+		config       *compressionConfig
+		compressors  []*compressor
+		contentTypes map[string]bool
+	}
+
+	// compressResponseWriter holds the first bytes of a response back until it knows whether the response is worth
+	// compressing: large enough, of a type in the allowlist and not encoded already.
+	compressResponseWriter struct {
+		http.ResponseWriter
+
+		compression *compression
+		compressor  *compressor
+		code        int
+		buf         []byte
+		decided     bool
+		encoder     encoder
+	}
+)
+
+const (
+	encodingGzip   = "gzip"
+	encodingBrotli = "br"
+	encodingZstd   = "zstd"
+
+	// brotliLevel trades ratio for speed on dynamic responses. Static files are compressed once with
+	// staticBrotliLevel, as the best level takes seconds on bundles such as Swagger UI for little gain.
+	brotliLevel       = 4
+	staticBrotliLevel = 9
+)
+
+func newCompression(cfg *compressionConfig) *compression {
+	compression := &compression{config: cfg, contentTypes: map[string]bool{}}
+
+	for _, name := range cfg.Encodings {
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		newEncoder, err := encoderFactory(name, false)
+		if err != nil {
+			log.Fatalf("failed to configure compression: %q", err)
+		}
+
+		c := &compressor{name: name}
+		c.pool.New = func() interface{} { return newEncoder() }
+
+		compression.compressors = append(compression.compressors, c)
+	}
+
+	for _, contentType := range cfg.ContentTypes {
+		compression.contentTypes[strings.ToLower(strings.TrimSpace(contentType))] = true
+	}
+
+	return compression
+}
+
+// encoderFactory returns a function making encoders for the content coding name, tuned for ratio over speed when
+// best is set.
+func encoderFactory(name string, best bool) (func() encoder, error) {
+	switch name {
+	case encodingGzip:
+		level := gzip.DefaultCompression
+		if best {
+			level = gzip.BestCompression
+		}
+
+		return func() encoder {
+			w, _ := gzip.NewWriterLevel(nil, level)
+			return w
+		}, nil
+	case encodingBrotli:
+		level := brotliLevel
+		if best {
+			level = staticBrotliLevel
+		}
+
+		return func() encoder { return brotli.NewWriterLevel(nil, level) }, nil
+	case encodingZstd:
+		level := zstd.SpeedDefault
+		if best {
+			level = zstd.SpeedBestCompression
+		}
+
+		return func() encoder {
+			w, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+			return w
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown content coding %q", name)
+}
+
+// negotiate returns the compressor of the content coding the client prefers in Accept-Encoding, or nil to send the
+// response as is. Codings the client accepts equally are tried in the order of COMPRESSION_ENCODINGS.
+func (compression *compression) negotiate(acceptEncoding string) *compressor {
+	names := make([]string, 0, len(compression.compressors))
+	for _, c := range compression.compressors {
+		names = append(names, c.name)
+	}
+
+	name := negotiateEncoding(acceptEncoding, names)
+
+	for _, c := range compression.compressors {
+		if c.name == name {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// compressible reports whether responses with header are of a type worth compressing.
+func (compression *compression) compressible(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return compression.contentTypes[mediaType]
+}
+
+// negotiateEncoding returns the coding of encodings, listed in order of preference, that has the highest weight in
+// the Accept-Encoding header, or an empty string when the client accepts none of them.
+func negotiateEncoding(acceptEncoding string, encodings []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	weights := map[string]float64{}
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		weight := 1.0
+
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+				weight = parsed
+			}
+		}
+
+		weights[strings.ToLower(strings.TrimSpace(name))] = weight
+	}
+
+	best, bestWeight := "", 0.0
+
+	for _, name := range encodings {
+		weight, ok := weights[name]
+		if !ok {
+			weight = weights["*"]
+		}
+
+		if weight > bestWeight {
+			best, bestWeight = name, weight
+		}
+	}
+
+	return best
+}
+
+// serverCompressionMiddleware compresses responses with the content coding negotiated with Accept-Encoding.
+// Responses smaller than COMPRESSION_MIN_BYTES, of types outside COMPRESSION_CONTENT_TYPES, already encoded,
+// partial, streamed or marked no-transform are sent as is. A strong ETag of a compressed response is made weak, as
+// the bytes sent differ from those it was computed on.
+func serverCompressionMiddleware(compression *compression, log *logging.Logger) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead || isWebSocketUpgrade(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			c := compression.negotiate(r.Header.Get("Accept-Encoding"))
+			if c == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressResponseWriter{ResponseWriter: w, compression: compression, compressor: c}
+
+			// not deferred: after a panic the buffered bytes are dropped, so that a problem can still be sent
+			next.ServeHTTP(cw, r)
+			cw.close()
+		}
+
+		log.Debug("use server compression middleware", zap.Strings("encodings", compression.config.Encodings))
+		return http.HandlerFunc(fn)
+	}
+}
+
+// WriteHeader implements http.ResponseWriter interface.
+func (cw *compressResponseWriter) WriteHeader(code int) {
+	if cw.decided {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	// informational responses, such as 103 Early Hints, come before the response itself
+	if code < http.StatusOK {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	if cw.code == 0 {
+		cw.code = code
+	}
+}
+
+// Write implements http.ResponseWriter interface.
+func (cw *compressResponseWriter) Write(p []byte) (int, error) {
+	if !cw.decided {
+		if cw.code == 0 {
+			cw.code = http.StatusOK
+		}
+
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) >= cw.compression.config.MinBytes {
+			if err := cw.decide(); err != nil {
+				return 0, err
+			}
+		}
+
+		return len(p), nil
+	}
+
+	if cw.encoder != nil {
+		return cw.encoder.Write(p)
+	}
+
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher interface.
+func (cw *compressResponseWriter) Flush() {
+	if !cw.decided {
+		if cw.code == 0 {
+			cw.code = http.StatusOK
+		}
+
+		if err := cw.decide(); err != nil {
+			return
+		}
+	}
+
+	if cw.encoder != nil {
+		_ = cw.encoder.Flush()
+	}
+
+	_ = http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap returns the http.ResponseWriter wrapped, for http.ResponseController.
+func (cw *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// decide sends the header of the response, compressed or not, followed by the bytes held back.
+func (cw *compressResponseWriter) decide() error {
+	cw.decided = true
+	header := cw.Header()
+
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	switch {
+	case cw.code == http.StatusNotModified:
+		// the 304 stands for the compressed response the client holds
+		header.Add("Vary", "Accept-Encoding")
+		weakenETag(header)
+	case cw.eligible(header):
+		header.Add("Vary", "Accept-Encoding")
+
+		if cw.largeEnough(header) {
+			cw.startEncoding(header)
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.code)
+
+	buf := cw.buf
+	cw.buf = nil
+
+	if len(buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+
+	return err
+}
+
+func (cw *compressResponseWriter) eligible(header http.Header) bool {
+	switch cw.code {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		return false
+	}
+
+	return header.Get("Content-Encoding") == "" &&
+		header.Get("Content-Range") == "" &&
+		!strings.Contains(header.Get("Cache-Control"), "no-transform") &&
+		!isStream(header) &&
+		cw.compression.compressible(header)
+}
+
+func (cw *compressResponseWriter) largeEnough(header http.Header) bool {
+	if len(cw.buf) >= cw.compression.config.MinBytes {
+		return true
+	}
+
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+
+	return err == nil && length >= cw.compression.config.MinBytes
+}
+
+func (cw *compressResponseWriter) startEncoding(header http.Header) {
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	header.Set("Content-Encoding", cw.compressor.name)
+	weakenETag(header)
+
+	cw.encoder = cw.compressor.pool.Get().(encoder)
+	cw.encoder.Reset(cw.ResponseWriter)
+}
+
+// weakenETag makes the ETag of header weak, as the bytes sent differ from those it was computed on.
+func weakenETag(header http.Header) {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// close sends what is held back and ends the encoded stream.
+func (cw *compressResponseWriter) close() {
+	if !cw.decided {
+		// nothing was written, net/http sends an empty 200 OK
+		if cw.code == 0 {
+			return
+		}
+
+		if err := cw.decide(); err != nil {
+			return
+		}
+	}
+
+	if cw.encoder == nil {
+		return
+	}
+
+	_ = cw.encoder.Close()
+	cw.encoder.Reset(io.Discard)
+	cw.compressor.pool.Put(cw.encoder)
+	cw.encoder = nil
+}
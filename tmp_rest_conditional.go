@@ -0,0 +1,250 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+// conditionalResponseWriter holds the JSON responses of GET requests back to hash them into an ETag, and answers
+// requests that already hold the response with 304 Not Modified instead.
+type conditionalResponseWriter struct {
+	http.ResponseWriter
+
+	request      *http.Request
+	config       *conditionalConfig
+	cacheControl string
+	conditional  bool
+	code         int
+	buf          []byte
+	started      bool
+	buffering    bool
+	notModified  bool
+}
+
+// serverConditionalMiddleware sends cacheControl as the Cache-Control of successful responses that do not set their
+// own, and handles conditional GET requests. The 200 OK JSON responses up to HTTP_ETAG_MAX_BYTES get an ETag unless
+// the handler set one; responses with an ETag or a Last-Modified are answered with 304 Not Modified when they match
+// If-None-Match or, without it, are not newer than If-Modified-Since.
+func serverConditionalMiddleware(
+	cfg *conditionalConfig,
+	cacheControl string,
+	log *logging.Logger,
+) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			conditional := r.Method == http.MethodGet || r.Method == http.MethodHead
+			if !conditional && cacheControl == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &conditionalResponseWriter{
+				ResponseWriter: w,
+				request:        r,
+				config:         cfg,
+				cacheControl:   cacheControl,
+				conditional:    conditional,
+			}
+
+			// not deferred: after a panic the buffered bytes are dropped, so that a problem can still be sent
+			next.ServeHTTP(cw, r)
+			cw.close()
+		}
+
+		log.Debug("use server conditional middleware", zap.String("cache_control", cacheControl))
+		return http.HandlerFunc(fn)
+	}
+}
+
+// WriteHeader implements http.ResponseWriter interface.
+func (cw *conditionalResponseWriter) WriteHeader(code int) {
+	if cw.started || code < http.StatusOK {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	cw.start(code)
+}
+
+// Write implements http.ResponseWriter interface.
+func (cw *conditionalResponseWriter) Write(p []byte) (int, error) {
+	if !cw.started {
+		cw.start(http.StatusOK)
+	}
+
+	if cw.notModified {
+		return len(p), nil
+	}
+
+	if cw.buffering {
+		cw.buf = append(cw.buf, p...)
+		if int64(len(cw.buf)) > cw.config.MaxBytes {
+			if err := cw.passThrough(); err != nil {
+				return 0, err
+			}
+		}
+
+		return len(p), nil
+	}
+
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher interface. A response flushed before it ends is sent without an ETag.
+func (cw *conditionalResponseWriter) Flush() {
+	if cw.buffering {
+		if err := cw.passThrough(); err != nil {
+			return
+		}
+	}
+
+	_ = http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap returns the http.ResponseWriter wrapped, for http.ResponseController.
+func (cw *conditionalResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *conditionalResponseWriter) start(code int) {
+	cw.started = true
+	cw.code = code
+	header := cw.Header()
+
+	if cw.cacheControl != "" && header.Get("Cache-Control") == "" &&
+		(code < http.StatusMultipleChoices || code == http.StatusNotModified) {
+		header.Set("Cache-Control", cw.cacheControl)
+	}
+
+	if !cw.conditional || code != http.StatusOK {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	if cw.config.ETags && header.Get("ETag") == "" && header.Get("Content-Range") == "" && isJSON(header) {
+		cw.buffering = true
+		return
+	}
+
+	if notModified(cw.request, header) {
+		cw.writeNotModified()
+		return
+	}
+
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+// passThrough gives up on the ETag and sends the response held back as it is.
+func (cw *conditionalResponseWriter) passThrough() error {
+	cw.buffering = false
+	cw.ResponseWriter.WriteHeader(cw.code)
+
+	buf := cw.buf
+	cw.buf = nil
+
+	_, err := cw.ResponseWriter.Write(buf)
+
+	return err
+}
+
+func (cw *conditionalResponseWriter) writeNotModified() {
+	cw.notModified = true
+
+	header := cw.Header()
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+
+	cw.ResponseWriter.WriteHeader(http.StatusNotModified)
+}
+
+// close sends the response held back with its ETag, or 304 Not Modified when the request already holds it.
+func (cw *conditionalResponseWriter) close() {
+	if !cw.buffering {
+		return
+	}
+
+	cw.buffering = false
+	cw.Header().Set("ETag", cw.etag())
+
+	if notModified(cw.request, cw.Header()) {
+		cw.writeNotModified()
+		return
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.code)
+	_, _ = cw.ResponseWriter.Write(cw.buf)
+	cw.buf = nil
+}
+
+func (cw *conditionalResponseWriter) etag() string {
+	sum := sha256.Sum256(cw.buf)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	if cw.config.WeakETags {
+		return "W/" + etag
+	}
+
+	return etag
+}
+
+// notModified reports whether the request already holds the response with header, as RFC 9110 evaluates
+// If-None-Match and If-Modified-Since.
+func notModified(r *http.Request, header http.Header) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := header.Get("ETag")
+
+		return etag != "" && etagMatches(ifNoneMatch, etag)
+	}
+
+	ifModifiedSince, lastModified := r.Header.Get("If-Modified-Since"), header.Get("Last-Modified")
+	if ifModifiedSince == "" || lastModified == "" {
+		return false
+	}
+
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+
+	return !modified.After(since)
+}
+
+// etagMatches reports whether the If-None-Match header matches etag, comparing weakly.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isJSON reports whether header is the header of a JSON document, including JSON based types such as
+// application/problem+json.
+func isJSON(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,245 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"go.uber.org/zap"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// contract validates requests, and optionally responses, against an OpenAPI document.
+	contract struct {
+		router    routers.Router
+		responses bool
+		options   *openapi3filter.Options
+	}
+
+	// recordingResponseWriter holds a response back so that it can be validated before it is sent.
+	recordingResponseWriter struct {
+		header http.Header
+		status int
+		body   bytes.Buffer
+	}
+)
+
+// contractFiles are the documents looked for in the embedded docs directory, for contract first services.
+var contractFiles = []string{"docs/openapi.yaml", "docs/openapi.yml", "docs/openapi.json"}
+
+// load reads the document to enforce: OPENAPI_VALIDATION_FILE, else an openapi.yaml or openapi.json embedded in
+// the docs directory, else the document generated from the registered endpoints. It is called once every endpoint
+// is registered, the middleware is installed before that.
+func (c *contract) load(cfg *openAPIValidationConfig, generated func() ([]byte, error)) {
+	content, err := contractDocument(cfg, generated)
+	if err != nil {
+		log.Fatalf("failed to read OpenAPI document: %q", err)
+	}
+
+	loader := openapi3.NewLoader()
+
+	document, err := loader.LoadFromData(content)
+	if err != nil {
+		log.Fatalf("failed to load OpenAPI document: %q", err)
+	}
+
+	router, err := gorillamux.NewRouter(document)
+	if err != nil {
+		log.Fatalf("failed to route OpenAPI document: %q", err)
+	}
+
+	c.router = router
+	c.responses = cfg.Responses
+	c.options = &openapi3filter.Options{
+		MultiError: true,
+		// the auth middleware has already authenticated the request
+		AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+	}
+}
+
+func contractDocument(cfg *openAPIValidationConfig, generated func() ([]byte, error)) ([]byte, error) {
+	if cfg.File != "" {
+		return os.ReadFile(cfg.File)
+	}
+
+	for _, name := range contractFiles {
+		content, err := fs.ReadFile(docsFS, name)
+		if err == nil {
+			return content, nil
+		}
+	}
+
+	return generated()
+}
+
+// serverContractMiddleware rejects requests that do not match the operation of the OpenAPI document they are for
+// with a 400 problem listing every violation. Requests for paths the document does not describe are passed on.
+// With OPENAPI_VALIDATION_RESPONSES responses are validated too, and one that breaks the contract is logged and
+// replaced with a 500, so that tests fail as soon as a handler drifts from the document.
+func serverContractMiddleware(c *contract, log *logging.Logger) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			route, pathParams, err := c.router.FindRoute(r)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			input := &openapi3filter.RequestValidationInput{
+				Request:    r,
+				PathParams: pathParams,
+				Route:      route,
+				Options:    c.options,
+			}
+
+			if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+				problem := NewProblem(http.StatusBadRequest, "request does not match the API contract")
+				problem.Errors = contractViolations(err)
+
+				writeProblem(w, r, problem)
+				return
+			}
+
+			if !c.responses {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			recorder := &recordingResponseWriter{header: http.Header{}}
+			next.ServeHTTP(recorder, r)
+
+			if err := c.validateResponse(r.Context(), input, recorder); err != nil {
+				log.Error(
+					"response does not match the API contract",
+					zap.String("http_method", r.Method),
+					zap.String("http_url", r.URL.Path),
+					zap.Int("http_status", recorder.status),
+					zap.Error(err),
+				)
+
+				problem := NewProblem(http.StatusInternalServerError, "response does not match the API contract")
+				problem.Errors = contractViolations(err)
+
+				writeProblem(w, r, problem)
+				return
+			}
+
+			recorder.flush(w)
+		}
+
+		log.Debug("use server contract middleware", zap.Bool("responses", c.responses))
+		return http.HandlerFunc(fn)
+	}
+}
+
+func (c *contract) validateResponse(
+	ctx context.Context,
+	input *openapi3filter.RequestValidationInput,
+	recorder *recordingResponseWriter,
+) error {
+	status := recorder.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	return openapi3filter.ValidateResponse(ctx, &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 status,
+		Header:                 recorder.header,
+		Body:                   io.NopCloser(bytes.NewReader(recorder.body.Bytes())),
+		Options:                c.options,
+	})
+}
+
+// contractViolations turns the errors of openapi3filter into problem fields named after the parameter or the JSON
+// pointer of the body value that is wrong.
+func contractViolations(err error) []ProblemField {
+	var errs openapi3.MultiError
+	if !errors.As(err, &errs) {
+		errs = openapi3.MultiError{err}
+	}
+
+	violations := make([]ProblemField, 0, len(errs))
+
+	for _, err := range errs {
+		field := "body"
+
+		var requestErr *openapi3filter.RequestError
+		if errors.As(err, &requestErr) && requestErr.Parameter != nil {
+			field = fmt.Sprintf("%s.%s", requestErr.Parameter.In, requestErr.Parameter.Name)
+		}
+
+		message := err.Error()
+
+		var schemaErr *openapi3.SchemaError
+		if errors.As(err, &schemaErr) {
+			message = schemaErr.Reason
+
+			if pointer := schemaErr.JSONPointer(); len(pointer) > 0 && field == "body" {
+				field = "body." + strings.Join(pointer, ".")
+			}
+		}
+
+		violations = append(violations, ProblemField{Field: field, Message: contractMessage(message)})
+	}
+
+	return violations
+}
+
+// contractMessage keeps the reason of message; the JSON Schema validator used for OpenAPI 3.1 documents reports it
+// on the last line, after the URL of the schema.
+func contractMessage(message string) string {
+	if i := strings.LastIndex(message, "\n"); i >= 0 {
+		message = strings.TrimPrefix(message[i+1:], "- ")
+	}
+
+	return message
+}
+
+// Header implements http.ResponseWriter interface.
+func (recorder *recordingResponseWriter) Header() http.Header {
+	return recorder.header
+}
+
+// WriteHeader implements http.ResponseWriter interface.
+func (recorder *recordingResponseWriter) WriteHeader(code int) {
+	if recorder.status == 0 {
+		recorder.status = code
+	}
+}
+
+// Write implements http.ResponseWriter interface.
+func (recorder *recordingResponseWriter) Write(body []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+
+	return recorder.body.Write(body)
+}
+
+func (recorder *recordingResponseWriter) flush(w http.ResponseWriter) {
+	for key, values := range recorder.header {
+		w.Header()[key] = values
+	}
+
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+
+	w.WriteHeader(recorder.status)
+	_, _ = w.Write(recorder.body.Bytes())
+}
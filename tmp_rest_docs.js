@@ -0,0 +1,8 @@
+window.onload = function () {
+    window.ui = SwaggerUIBundle({
+        url: "/openapi.json",
+        dom_id: "#swagger-ui",
+        deepLinking: true,
+        persistAuthorization: true
+    });
+};
@@ -1,13 +1,17 @@
 package rest
 
 import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
 	"net/http"
-	"os"
 
 	"github.com/alexliesenfeld/health"
 	"github.com/go-chi/chi"
 	chiMiddleware "github.com/go-chi/chi/middleware"
 	"github.com/nicklaw5/go-respond"
+	swaggerFiles "github.com/swaggo/files/v2"
 	"go.uber.org/zap"
 	{{range .imports}}
 	"{{.}}"
@@ -31,40 +35,99 @@ type (
 		log    *logging.Logger
 		client *httpclient.ExampleClient
 	}
-)
 
-const (
-	docsPath = "./docs"
+	// ExampleSocketEndpoint represents the example WebSocket endpoint, it echoes the messages it receives.
+	ExampleSocketEndpoint struct{ log *logging.Logger }
+
+	// exampleMessage is a message of the example WebSocket endpoint.
+	exampleMessage struct {
+		Text string `json:"text"`
+	}
+
+	// exampleRequest is decoded from the request by Handle. Use it as an example to declare endpoint input.
+	exampleRequest struct {
+		Name string `query:"name" validate:"omitempty,max=64"`
+	}
+
+	// exampleResponse is sent as the JSON body of the example endpoint.
+	exampleResponse struct {
+		Message string `json:"message"`
+	}
 )
 
+// docsCacheControl lets caches keep the docs, checking them against their ETag as they change with each release.
+const docsCacheControl = "public, no-cache"
+
+// swaggerUIFiles are the files of swagger-ui-dist the docs page loads.
+var swaggerUIFiles = []string{"swagger-ui.css", "swagger-ui-bundle.js"}
+
+//go:embed docs
+var docsFS embed.FS
+
 // RegisterAPIEndpoints registers all REST API endpoints.
 func RegisterAPIEndpoints(server *APIServer, endpoints []Endpoint) {
 	server = server.withMetrics("{{.serviceName}}")
 
 	server.log.Debug("registering all REST API endpoints")
 
+	server.router.NotFound(serverNotFoundHandler)
+	server.router.MethodNotAllowed(serverMethodNotAllowedHandler)
+
 	server.router.Use(
+		serverDrainMiddleware(server.drain, server.log),
 		chiMiddleware.StripSlashes,
-		chiMiddleware.Recoverer,
+		serverTracingMiddleware(server.log),
+		serverMetricsMiddleware(server.collector, server.log),
+		serverRecoveryMiddleware(server.collector, server.log),
 	)
 
+	if server.compression != nil {
+		server.router.Use(serverCompressionMiddleware(server.compression, server.log))
+	}
+
+	if server.config.SecurityHeaders.Enabled {
+		server.router.Use(serverSecurityHeadersMiddleware(
+			securityHeaders(server.config.SecurityHeaders, server.config.SecurityHeaders.ContentSecurityPolicy),
+			server.log,
+		))
+	}
+
+	if server.cors != nil {
+		server.router.Use(serverCORSMiddleware(server.cors, server.log))
+	}
+
 	server.router.Group(func(r chi.Router) {
 		r.Use(
-			serverAuthUserMiddleware(server.log),
-			serverTracingMiddleware(server.log),
-			serverMetricsMiddleware(server.collector, server.log),
+			serverAuthUserMiddleware(server.authenticator, server.collector, server.audit, server.log),
+			serverTenantMiddleware(server.config.Tenant, server.log),
 			chiMiddleware.RequestLogger(newAPIRequestLogger(server.log.Logger)),
+			serverWebSocketMiddleware(
+				newWebSocketServer(server.config.WebSocket, server.collector, server.log),
+				server.log,
+			),
 		)
 
 		for _, endpoint := range endpoints {
 			switch endpoint.(type) {
 			case *ExampleEndpoint:
-				r.Get("/example-endpoint", endpoint.Handler())
+				server.handle(r, http.MethodGet, "/example-endpoint", endpoint)
+			case *ExampleSocketEndpoint:
+				server.handle(r, http.MethodGet, "/example-socket", endpoint)
 			}
 		}
 	})
 
 	registerPublicEndpoints(server, endpoints)
+
+	if server.admin != nil {
+		registerAdminEndpoints(server, endpoints)
+	}
+
+	if server.contract != nil {
+		server.contract.load(server.config.OpenAPIValidation, func() ([]byte, error) {
+			return server.OpenAPI().JSON()
+		})
+	}
 }
 
 func registerPublicEndpoints(server *APIServer, endpoints []Endpoint) {
@@ -74,12 +137,28 @@ func registerPublicEndpoints(server *APIServer, endpoints []Endpoint) {
 			case *IndexEndpoint:
 				r.Get("/", endpoint.Handler())
 			case *DocsEndpoint:
-				r.Handle("/docs/*", endpoint.Handler())
+				docs := r
+				if server.config.SecurityHeaders.Enabled {
+					docs = r.With(serverSecurityHeadersMiddleware(
+						securityHeaders(server.config.SecurityHeaders, server.config.SecurityHeaders.DocsContentSecurityPolicy),
+						server.log,
+					))
+				}
+
+				docs.Handle("/docs", endpoint.Handler())
+				docs.Handle("/docs/*", endpoint.Handler())
 			case *StatusEndpoint:
-				r.Get("/status", endpoint.Handler())
+				if server.admin == nil {
+					r.Get("/status", server.readiness(endpoint.Handler()))
+				}
 			}
 		}
-		r.Handle("/metrics", server.instrumentation.Endpoint())
+		r.Get("/openapi.json", server.serveOpenAPI("application/json", (*OpenAPI).JSON))
+		r.Get("/openapi.yaml", server.serveOpenAPI("application/yaml", (*OpenAPI).YAML))
+
+		if server.admin == nil {
+			r.Handle("/metrics", server.instrumentation.Endpoint())
+		}
 	})
 }
 
@@ -91,18 +170,29 @@ func (handler *IndexEndpoint) Handler() http.HandlerFunc {
 	}
 }
 
-// Handler returns the handler function for the docs endpoint.
+// Handler returns the handler function for the docs endpoint. The page and the Swagger UI it runs, pointed at the
+// generated /openapi.json, are embedded in the binary and served pre-compressed.
 func (handler *DocsEndpoint) Handler() http.HandlerFunc {
-	if _, err := os.Stat(docsPath); os.IsNotExist(err) {
-		handler.log.Error("failed to fetch api docs", zap.Error(err))
+	static := newStaticHandler(docsCacheControl)
+
+	docs, err := fs.Sub(docsFS, "docs")
+	if err == nil {
+		err = static.add(docs, "index.html", "index.js")
+	}
+
+	if err == nil {
+		err = static.add(swaggerFiles.FS, swaggerUIFiles...)
+	}
+
+	if err != nil {
+		handler.log.Error("failed to load api docs", zap.Error(err))
 
 		return func(w http.ResponseWriter, r *http.Request) {
-			respond.NewResponse(w).InternalServerError(map[string]string{"error": err.Error()})
+			writeProblem(w, r, NewProblem(http.StatusInternalServerError, "api documentation is not available"))
 		}
 	}
 
-	fs := http.FileServer(http.Dir(docsPath))
-	return http.StripPrefix("/docs", fs).ServeHTTP
+	return http.StripPrefix("/docs", static).ServeHTTP
 }
 
 // Handler returns the handler function for the status endpoint.
@@ -110,19 +200,59 @@ func (handler *StatusEndpoint) Handler() http.HandlerFunc {
 	return health.NewHandler(handler.healthChecker)
 }
 
+// Authorization implements AuthorizedEndpoint, callers need the example:read scope.
+func (handler *ExampleEndpoint) Authorization() Authorization {
+	return Authorization{Scopes: []string{"example:read"}}
+}
+
+// Operation implements DescribedEndpoint.
+func (handler *ExampleEndpoint) Operation() Operation {
+	operation := Describe[exampleRequest, exampleResponse]("Call the example service")
+	operation.Tags = []string{"example"}
+
+	return operation
+}
+
+// CacheControl implements CachedEndpoint. Responses depend on the caller, so only the cache of the caller may keep
+// them, and it checks them against their ETag before each use.
+func (handler *ExampleEndpoint) CacheControl() string {
+	return "private, no-cache"
+}
+
 // Handler returns the handler function for the example endpoint.
 func (handler *ExampleEndpoint) Handler() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		handler.log.Debug("example endpoint hit")
+	return Handle(handler.log, handler.example)
+}
 
-		// call to external service should happen via the domain, like using a use case or domain service
-		if err := handler.client.ExternalRequest(r.Context()); err != nil {
-			handler.log.Error("failed to make external request", zap.Error(err))
-			respond.NewResponse(w).InternalServerError(serverResponse{"error": err.Error()})
-			return
-		}
+func (handler *ExampleEndpoint) example(ctx context.Context, req exampleRequest) (exampleResponse, error) {
+	handler.log.Debug("example endpoint hit", zap.String("name", req.Name))
+
+	// call to external service should happen via the domain, like using a use case or domain service
+	if err := handler.client.ExternalRequest(ctx); err != nil {
+		return exampleResponse{}, NewError(http.StatusBadGateway, "example service is unavailable", err)
+	}
 
-		respond.NewResponse(w).Ok(serverResponse{"message": "example endpoint hit"})
+	if req.Name != "" {
+		return exampleResponse{Message: fmt.Sprintf("example endpoint hit by %s", req.Name)}, nil
 	}
+
+	return exampleResponse{Message: "example endpoint hit"}, nil
+}
+
+// Handler returns the handler function for the example WebSocket endpoint.
+func (handler *ExampleSocketEndpoint) Handler() http.HandlerFunc {
+	return HandleWebSocket(handler.log, handler.echo)
 }
 
+func (handler *ExampleSocketEndpoint) echo(ctx context.Context, ws *WebSocket[exampleMessage, exampleMessage]) error {
+	for {
+		msg, err := ws.Read(ctx)
+		if err != nil {
+			return err
+		}
+
+		if err := ws.Write(ctx, msg); err != nil {
+			return err
+		}
+	}
+}
@@ -3,10 +3,13 @@ package rest
 import (
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/alexliesenfeld/health"
 	"github.com/go-chi/chi"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 
     {{range .imports}}
@@ -15,7 +18,189 @@ import (
 )
 
 type (
-	config struct {}
+	config struct {
+		Auth              *authConfig
+		RateLimit         *rateLimitConfig
+		Tenant            *tenantConfig
+		OpenAPIValidation *openAPIValidationConfig
+		CORS              *corsConfig
+		SecurityHeaders   *securityHeadersConfig
+		HTTP              *httpConfig
+		Idempotency       *idempotencyConfig
+		TLS               *tlsConfig
+		Admin             *adminConfig
+		Shutdown          *shutdownConfig
+		WebSocket         *webSocketConfig
+		Compression       *compressionConfig
+		Conditional       *conditionalConfig
+	}
+
+	// compressionConfig compresses responses of ContentTypes from MinBytes on with the content coding negotiated
+	// with Accept-Encoding. Encodings are gzip, br and zstd, in order of preference.
+	compressionConfig struct {
+		Enabled      bool     `envconfig:"COMPRESSION_ENABLED" default:"true"`
+		Encodings    []string `envconfig:"COMPRESSION_ENCODINGS" default:"zstd,br,gzip"`
+		MinBytes     int      `envconfig:"COMPRESSION_MIN_BYTES" default:"1024"`
+		ContentTypes []string `envconfig:"COMPRESSION_CONTENT_TYPES" default:"application/json,application/problem+json,application/yaml,application/javascript,text/html,text/css,text/plain,image/svg+xml"`
+	}
+
+	// conditionalConfig adds an ETag to the JSON responses of GET requests up to MaxBytes, which are held back to
+	// hash them, and answers requests that already hold the response with 304 Not Modified.
+	conditionalConfig struct {
+		ETags bool `envconfig:"HTTP_ETAGS_ENABLED" default:"true"`
+		// WeakETags marks the ETags weak, for responses that are equivalent without being equal byte for byte.
+		WeakETags bool  `envconfig:"HTTP_WEAK_ETAGS" default:"false"`
+		MaxBytes  int64 `envconfig:"HTTP_ETAG_MAX_BYTES" default:"1048576"`
+	}
+
+	webSocketConfig struct {
+		// AllowedOrigins are the host patterns, as in path.Match, of the pages allowed to open connections, for
+		// example "app.example.com,*.example.com". Connections from pages on the host of the API are always allowed.
+		AllowedOrigins  []string `envconfig:"WEBSOCKET_ALLOWED_ORIGINS"`
+		MaxMessageBytes int64    `envconfig:"WEBSOCKET_MAX_MESSAGE_BYTES" default:"32768"`
+		// MessageRateLimit limits the messages a connection may send with <messages per second>/<burst>.
+		MessageRateLimit string        `envconfig:"WEBSOCKET_MESSAGE_RATE_LIMIT" default:"10/20"`
+		PingInterval     time.Duration `envconfig:"WEBSOCKET_PING_INTERVAL" default:"30s"`
+		PongTimeout      time.Duration `envconfig:"WEBSOCKET_PONG_TIMEOUT" default:"10s"`
+		WriteTimeout     time.Duration `envconfig:"WEBSOCKET_WRITE_TIMEOUT" default:"10s"`
+	}
+
+	// shutdownConfig sets the steps of a graceful shutdown. PreStopDelay lets load balancers see the failing readiness
+	// probe before the listener closes, DrainTimeout bounds the wait for in-flight requests and TelemetryTimeout the
+	// flush of spans. Keep their sum under the grace period of the orchestrator, 30s in Kubernetes by default.
+	shutdownConfig struct {
+		PreStopDelay     time.Duration `envconfig:"SHUTDOWN_PRE_STOP_DELAY" default:"5s"`
+		DrainTimeout     time.Duration `envconfig:"SHUTDOWN_DRAIN_TIMEOUT" default:"20s"`
+		TelemetryTimeout time.Duration `envconfig:"SHUTDOWN_TELEMETRY_TIMEOUT" default:"5s"`
+	}
+
+	// adminConfig turns the admin server on when Address is set; it then serves /metrics and /status instead of
+	// the API server. Changing the log level and pprof need Username and Password.
+	adminConfig struct {
+		Address      string `envconfig:"ADMIN_SERVER_ADDRESS"`
+		Username     string `envconfig:"ADMIN_USERNAME"`
+		Password     string `envconfig:"ADMIN_PASSWORD"`
+		PprofEnabled bool   `envconfig:"ADMIN_PPROF_ENABLED" default:"false"`
+	}
+
+	// tlsConfig turns TLS on when CertFile and KeyFile are set.
+	tlsConfig struct {
+		CertFile string `envconfig:"TLS_CERT_FILE"`
+		KeyFile  string `envconfig:"TLS_KEY_FILE"`
+		// MinVersion is 1.2 or 1.3.
+		MinVersion string `envconfig:"TLS_MIN_VERSION" default:"1.2"`
+		// CipherSuites are Go cipher suite names for TLS 1.2, for example TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256.
+		CipherSuites []string `envconfig:"TLS_CIPHER_SUITES"`
+		// ClientAuth is none, verify_if_given or require; client certificates are verified against ClientCAFile.
+		ClientAuth     string        `envconfig:"TLS_CLIENT_AUTH" default:"none"`
+		ClientCAFile   string        `envconfig:"TLS_CLIENT_CA_FILE"`
+		// ReloadInterval is how often the files are checked for changes, 0 turns reloading off.
+		ReloadInterval time.Duration `envconfig:"TLS_RELOAD_INTERVAL" default:"30s"`
+	}
+
+	httpConfig struct {
+		ReadHeaderTimeout time.Duration `envconfig:"HTTP_READ_HEADER_TIMEOUT" default:"10s"`
+		ReadTimeout       time.Duration `envconfig:"HTTP_READ_TIMEOUT" default:"30s"`
+		WriteTimeout      time.Duration `envconfig:"HTTP_WRITE_TIMEOUT" default:"30s"`
+		IdleTimeout       time.Duration `envconfig:"HTTP_IDLE_TIMEOUT" default:"120s"`
+		MaxHeaderBytes    int           `envconfig:"HTTP_MAX_HEADER_BYTES" default:"1048576"`
+		// MaxBodyBytes and RequestTimeout are the default limits of the requests to API endpoints.
+		MaxBodyBytes   int64         `envconfig:"HTTP_MAX_BODY_BYTES" default:"1048576"`
+		RequestTimeout time.Duration `envconfig:"HTTP_REQUEST_TIMEOUT" default:"15s"`
+		// RouteLimits overrides the limits of route patterns with <timeout>/<max body bytes>, for example
+		// "/example-endpoint:2s/1024".
+		RouteLimits map[string]string `envconfig:"HTTP_ROUTE_LIMITS"`
+	}
+
+	authConfig struct {
+		Disabled      bool     `envconfig:"AUTH_DISABLED" default:"false"`
+		Realm         string   `envconfig:"AUTH_REALM" default:"api"`
+		JWTAlgorithms []string `envconfig:"AUTH_JWT_ALGORITHMS" default:"HS256,RS256,ES256"`
+		JWTHMACSecret string   `envconfig:"AUTH_JWT_HMAC_SECRET"`
+		// JWTPublicKeyFile is a PEM encoded RSA or ECDSA public key used for tokens without a key id.
+		JWTPublicKeyFile    string        `envconfig:"AUTH_JWT_PUBLIC_KEY_FILE"`
+		JWKSFile            string        `envconfig:"AUTH_JWKS_FILE"`
+		JWKSURL             string        `envconfig:"AUTH_JWKS_URL"`
+		JWKSRefreshInterval time.Duration `envconfig:"AUTH_JWKS_REFRESH_INTERVAL" default:"15m"`
+		JWTIssuer           string        `envconfig:"AUTH_JWT_ISSUER"`
+		JWTAudience         string        `envconfig:"AUTH_JWT_AUDIENCE"`
+		JWTClockSkew        time.Duration `envconfig:"AUTH_JWT_CLOCK_SKEW" default:"30s"`
+		APIKeyHeader        string        `envconfig:"AUTH_API_KEY_HEADER" default:"X-API-Key"`
+		APIKeysFile         string        `envconfig:"AUTH_API_KEYS_FILE"`
+		// APIKeyBackends are the stores API keys are looked up in, in order: config for AUTH_API_KEYS_FILE and
+		// postgres for the api_keys table when the service has a database. It defaults to config when
+		// AUTH_API_KEYS_FILE is set and to no store otherwise.
+		APIKeyBackends []string `envconfig:"AUTH_API_KEY_BACKENDS"`
+	}
+
+	rateLimitConfig struct {
+		Enabled bool `envconfig:"RATE_LIMIT_ENABLED" default:"true"`
+		// Backend is where buckets are kept: memory, or redis to share them between instances.
+		Backend string  `envconfig:"RATE_LIMIT_BACKEND" default:"memory"`
+		Rate    float64 `envconfig:"RATE_LIMIT_RATE" default:"10"`
+		Burst   int     `envconfig:"RATE_LIMIT_BURST" default:"20"`
+		// Routes overrides the limit of route patterns with <rate>/<burst>, for example "/example-endpoint:1/5".
+		Routes map[string]string `envconfig:"RATE_LIMIT_ROUTES"`
+		// TrustedProxies are the CIDRs of the proxies whose X-Forwarded-For header is believed.
+		TrustedProxies []string `envconfig:"TRUSTED_PROXIES"`
+		RedisServer    string   `envconfig:"REDIS_SERVER"`
+	}
+
+	openAPIValidationConfig struct {
+		Enabled bool `envconfig:"OPENAPI_VALIDATION_ENABLED" default:"false"`
+		// File is the OpenAPI document to enforce instead of the embedded or generated one.
+		File string `envconfig:"OPENAPI_VALIDATION_FILE"`
+		// Responses validates responses as well, meant for tests; it holds every response back until validated.
+		Responses bool `envconfig:"OPENAPI_VALIDATION_RESPONSES" default:"false"`
+	}
+
+	idempotencyConfig struct {
+		// Backend is the store of idempotency keys: memory, redis, or postgres when the service has a database.
+		Backend string `envconfig:"IDEMPOTENCY_BACKEND" default:"memory"`
+		// Routes are the route patterns whose unsafe methods honor the Idempotency-Key header.
+		Routes      []string      `envconfig:"IDEMPOTENCY_ROUTES"`
+		Required    bool          `envconfig:"IDEMPOTENCY_KEY_REQUIRED" default:"false"`
+		TTL         time.Duration `envconfig:"IDEMPOTENCY_TTL" default:"24h"`
+		LockTimeout time.Duration `envconfig:"IDEMPOTENCY_LOCK_TIMEOUT" default:"1m"`
+		RedisServer string        `envconfig:"REDIS_SERVER"`
+	}
+
+	corsConfig struct {
+		Enabled bool `envconfig:"CORS_ENABLED" default:"false"`
+		// AllowedOrigins may hold one wildcard per origin, for example "https://*.example.com".
+		AllowedOrigins   []string `envconfig:"CORS_ALLOWED_ORIGINS"`
+		AllowedMethods   []string `envconfig:"CORS_ALLOWED_METHODS" default:"GET,POST,PUT,PATCH,DELETE"`
+		AllowedHeaders   []string `envconfig:"CORS_ALLOWED_HEADERS" default:"Accept,Authorization,Content-Type,Idempotency-Key,X-Request-ID,X-Correlation-ID,traceparent,tracestate"`
+		ExposedHeaders   []string `envconfig:"CORS_EXPOSED_HEADERS" default:"Location,Retry-After,RateLimit-Limit,RateLimit-Remaining,RateLimit-Reset,Idempotent-Replayed,X-Request-ID,X-Correlation-ID"`
+		AllowCredentials bool     `envconfig:"CORS_ALLOW_CREDENTIALS" default:"false"`
+		// MaxAge is how long browsers may cache the answer to a preflight request.
+		MaxAge time.Duration `envconfig:"CORS_MAX_AGE" default:"10m"`
+	}
+
+	securityHeadersConfig struct {
+		Enabled bool `envconfig:"SECURITY_HEADERS_ENABLED" default:"true"`
+		// HSTSMaxAge is the max-age of Strict-Transport-Security, 0 leaves the header out.
+		HSTSMaxAge            time.Duration `envconfig:"HSTS_MAX_AGE" default:"8760h"`
+		HSTSIncludeSubdomains bool          `envconfig:"HSTS_INCLUDE_SUBDOMAINS" default:"true"`
+		HSTSPreload           bool          `envconfig:"HSTS_PRELOAD" default:"false"`
+		ContentSecurityPolicy string        `envconfig:"CONTENT_SECURITY_POLICY" default:"default-src 'none'; frame-ancestors 'none'"`
+		// DocsContentSecurityPolicy replaces ContentSecurityPolicy for the docs UI, which runs the Swagger UI served
+		// with it and sets inline styles.
+		DocsContentSecurityPolicy string `envconfig:"DOCS_CONTENT_SECURITY_POLICY" default:"default-src 'self'; script-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; connect-src 'self'; frame-ancestors 'none'"`
+		ReferrerPolicy            string `envconfig:"REFERRER_POLICY" default:"no-referrer"`
+		FrameOptions              string `envconfig:"FRAME_OPTIONS" default:"DENY"`
+	}
+
+	tenantConfig struct {
+		// Source is where the tenant is read from: none, header, subdomain or claim.
+		Source string `envconfig:"TENANT_SOURCE" default:"none"`
+		Header string `envconfig:"TENANT_HEADER" default:"X-Tenant-ID"`
+		Claim  string `envconfig:"TENANT_CLAIM" default:"tenant"`
+		// Domain is the domain tenants are subdomains of with the subdomain source, for example api.example.com
+		// serves acme.api.example.com to the tenant acme.
+		Domain   string `envconfig:"TENANT_DOMAIN"`
+		Required bool   `envconfig:"TENANT_REQUIRED" default:"false"`
+	}
 )
 
 func newConfig() *config {
@@ -35,14 +220,94 @@ func newAPIRequestLogger(logger *zap.Logger) apiRequestLogger {
 }
 
 // NewAPIServer returns a new instance of APIServer.
-func NewAPIServer(instrumentation *telemetry.Instrumentation) *APIServer {
-	return &APIServer{
-		Server:          &http.Server{ReadHeaderTimeout: timeout},
+func NewAPIServer(
+	instrumentation *telemetry.Instrumentation,
+	keyStores []APIKeyStore,
+	idempotencyStores []IdempotencyStore,
+) *APIServer {
+	cfg := newConfig()
+	logger := logging.NewLogger()
+
+	checkTLSConfig(cfg.TLS)
+
+	if cfg.Tenant.Source == tenantSourceSubdomain && strings.Trim(cfg.Tenant.Domain, ".") == "" {
+		log.Fatalf("failed to configure tenants: TENANT_DOMAIN is required with TENANT_SOURCE=subdomain")
+	}
+
+	server := &APIServer{
+		Server: &http.Server{
+			ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+			ReadTimeout:       cfg.HTTP.ReadTimeout,
+			WriteTimeout:      cfg.HTTP.WriteTimeout,
+			IdleTimeout:       cfg.HTTP.IdleTimeout,
+			MaxHeaderBytes:    cfg.HTTP.MaxHeaderBytes,
+		},
 		router:          chi.NewMux(),
-		config:          newConfig(),
-		log:             logging.NewLogger(),
+		config:          cfg,
+		authenticator:   newAuthenticator(cfg.Auth, cfg.TLS, keyStores, logger),
+		log:             logger,
+		audit:           logging.NewAuditLogger(),
 		instrumentation: instrumentation,
+		drain:           newDrainTracker(),
+	}
+
+	if cfg.OpenAPIValidation.Enabled {
+		server.contract = new(contract)
+	}
+
+	if cfg.Admin.Address != "" {
+		server.admin = newAdminServer(cfg.Admin, cfg.HTTP, logger)
+	}
+
+	if cfg.TLS.enabled() {
+		server.certificates = newCertificateReloader(cfg.TLS, logger)
+		server.TLSConfig = newTLSConfig(cfg.TLS, server.certificates)
+	}
+
+	if len(cfg.Idempotency.Routes) > 0 {
+		server.idempotencyStore = idempotencyStore(cfg.Idempotency.Backend, idempotencyStores)
+	}
+
+	if cfg.CORS.Enabled {
+		server.cors = newCORS(cfg.CORS, cfg.Auth, cfg.Tenant)
+	}
+
+	if cfg.Compression.Enabled {
+		server.compression = newCompression(cfg.Compression)
+	}
+
+	if cfg.RateLimit.Enabled {
+		server.rateLimiter = newRateLimiter(cfg.RateLimit)
+		server.clientIdentifier = newClientIdentifier(cfg.RateLimit)
 	}
+
+	return server
+}
+
+// NewConfigAPIKeyStore returns a ConfigAPIKeyStore with the keys listed in AUTH_API_KEYS_FILE.
+func NewConfigAPIKeyStore() *ConfigAPIKeyStore {
+	keys, err := readAPIKeysFile(newConfig().Auth.APIKeysFile)
+	if err != nil {
+		log.Fatalf("failed to load api keys: %q", err)
+	}
+
+	return &ConfigAPIKeyStore{keys: keys}
+}
+
+// NewIdempotencyStore returns the in memory store of idempotency keys, or the Redis one when IDEMPOTENCY_BACKEND is
+// redis. The postgres backend is served by the repository package.
+func NewIdempotencyStore() IdempotencyStore {
+	cfg := newConfig().Idempotency
+
+	if cfg.Backend != idempotencyBackendRedis {
+		return &memoryIdempotencyStore{records: map[string]*memoryIdempotencyRecord{}, lastSweep: time.Now()}
+	}
+
+	if cfg.RedisServer == "" {
+		log.Fatalf("failed to create idempotency store: REDIS_SERVER is not set")
+	}
+
+	return &redisIdempotencyStore{client: redis.NewClient(&redis.Options{Addr: cfg.RedisServer})}
 }
 
 // NewIndexEndpoint returns a new instance of indexEndpoint.
@@ -60,6 +325,11 @@ func NewStatusEndpoint(healthChecker health.Checker) *StatusEndpoint {
 	return &StatusEndpoint{healthChecker: healthChecker}
 }
 
+// NewExampleSocketEndpoint returns a new instance of ExampleSocketEndpoint.
+func NewExampleSocketEndpoint() *ExampleSocketEndpoint {
+	return &ExampleSocketEndpoint{log: logging.NewLogger()}
+}
+
 // NewExampleEndpoint returns a new instance of ExampleEndpoint.
 func NewExampleEndpoint(client *httpclient.ExampleClient) *ExampleEndpoint {
 	return &ExampleEndpoint{
@@ -0,0 +1,451 @@
+package rest
+
+import (
+	"context"
+	"database/sql"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-playground/validator/v10"
+	"go.uber.org/zap"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// Error is an error with the status code it maps to and a message that is safe to show to clients. The wrapped
+	// error is logged, never sent. Type optionally names the kind of problem with a URI, see Problem.
+	Error struct {
+		Status  int
+		Message string
+		Type    string
+		Err     error
+	}
+
+	// StatusCoder is implemented by responses that are not sent with 200 OK.
+	StatusCoder interface {
+		StatusCode() int
+	}
+
+	// NoContent is the response of handlers that send no body, it is sent with 204 No Content.
+	NoContent struct{}
+
+	// requestError is returned when a request cannot be decoded or does not pass validation.
+	requestError struct {
+		message string
+		fields  []ProblemField
+	}
+
+	errorMapping struct {
+		target error
+		status int
+	}
+)
+
+const (
+	pathTag   = "path"
+	queryTag  = "query"
+	headerTag = "header"
+
+	deadlineExceededDetail = "request did not complete before its deadline"
+)
+
+var (
+	validate = newValidator()
+
+	errorMappingsMutex sync.RWMutex
+	errorMappings      = []errorMapping{
+		{target: sql.ErrNoRows, status: http.StatusNotFound},
+		{target: tenant.ErrMissing, status: http.StatusBadRequest},
+		{target: tenant.ErrInvalid, status: http.StatusBadRequest},
+		{target: context.DeadlineExceeded, status: http.StatusGatewayTimeout},
+	}
+
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	durationType        = reflect.TypeOf(time.Duration(0))
+)
+
+// NewError returns an Error that is sent as status with message.
+func NewError(status int, message string, err error) *Error {
+	return &Error{Status: status, Message: message, Err: err}
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+
+	return fmt.Sprintf("%s: %s", e.Message, e.Err)
+}
+
+// Unwrap returns the wrapped error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// StatusCode implements StatusCoder.
+func (NoContent) StatusCode() int {
+	return http.StatusNoContent
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// MapError makes handlers answer errors matching target, as in errors.Is, with status. Call it during start up,
+// for example MapError(domain.ErrOrderNotFound, http.StatusNotFound).
+func MapError(target error, status int) {
+	errorMappingsMutex.Lock()
+	defer errorMappingsMutex.Unlock()
+
+	errorMappings = append(errorMappings, errorMapping{target: target, status: status})
+}
+
+// Handle adapts fn to an http.HandlerFunc. The request is decoded into Req from the JSON body and from the fields
+// tagged with path, query and header, then validated with the validate tags. Resp is sent as JSON with the status
+// it reports through StatusCoder, or 200 OK. Errors are sent as a Problem with the status they map to; their text
+// is only sent for Error values, everything else is logged and answered with the status text.
+//
+//	type getOrderRequest struct {
+//		ID     string `path:"id" validate:"required,uuid"`
+//		Expand bool   `query:"expand"`
+//	}
+func Handle[Req any, Resp any](
+	log *logging.Logger,
+	fn func(ctx context.Context, req Req) (Resp, error),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req Req
+
+		if err := decode(r, &req); err != nil {
+			writeError(w, r, log, err)
+			return
+		}
+
+		resp, err := fn(r.Context(), req)
+		if err != nil {
+			writeError(w, r, log, err)
+			return
+		}
+
+		status := http.StatusOK
+		if coder, ok := any(resp).(StatusCoder); ok {
+			status = coder.StatusCode()
+		}
+
+		if status == http.StatusNoContent {
+			w.WriteHeader(status)
+			return
+		}
+
+		writeJSON(w, status, resp)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, log *logging.Logger, err error) {
+	problem := errorProblem(err)
+
+	// the deadline of the route passed, as opposed to a call with a deadline of its own
+	if errors.Is(err, context.DeadlineExceeded) && errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		problem = NewProblem(http.StatusServiceUnavailable, deadlineExceededDetail)
+	}
+
+	if problem.Status >= http.StatusInternalServerError {
+		log.Error(
+			"request failed",
+			zap.String("http_url", r.URL.Path),
+			zap.String("http_route", routePattern(r)),
+			zap.Int("http_status", problem.Status),
+			logging.CorrelationIDField(logging.GetCorrelationIDFromCtx(r.Context())),
+			zap.Error(err),
+		)
+	}
+
+	writeProblem(w, r, problem)
+}
+
+func errorProblem(err error) *Problem {
+	var requestErr *requestError
+	if errors.As(err, &requestErr) {
+		problem := NewProblem(http.StatusBadRequest, requestErr.message)
+		problem.Errors = requestErr.fields
+
+		return problem
+	}
+
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		problem := NewProblem(apiErr.Status, apiErr.Message)
+		if apiErr.Type != "" {
+			problem.Type = apiErr.Type
+		}
+
+		return problem
+	}
+
+	errorMappingsMutex.RLock()
+	defer errorMappingsMutex.RUnlock()
+
+	for _, mapping := range errorMappings {
+		if errors.Is(err, mapping.target) {
+			return NewProblem(mapping.status, "")
+		}
+	}
+
+	return NewProblem(http.StatusInternalServerError, "")
+}
+
+// decode fills req from r and validates it. Fields tagged path, query or header only take their values from the
+// path, query and headers: whatever the body set them to is dropped, so that callers cannot spoof them.
+func decode(r *http.Request, req interface{}) error {
+	value := reflect.ValueOf(req).Elem()
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+
+	if r.Body != nil && r.Body != http.NoBody {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+
+		if err := decoder.Decode(req); err != nil && !errors.Is(err, io.EOF) {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return NewError(
+					http.StatusRequestEntityTooLarge,
+					fmt.Sprintf("request body is larger than %d bytes", maxBytesErr.Limit),
+					err,
+				)
+			}
+
+			return &requestError{message: fmt.Sprintf("invalid request body: %s", jsonErrorMessage(err))}
+		}
+	}
+
+	if err := decodeParams(r, value); err != nil {
+		return err
+	}
+
+	if err := validate.Struct(req); err != nil {
+		var invalid validator.ValidationErrors
+		if !errors.As(err, &invalid) {
+			return err
+		}
+
+		fields := make([]ProblemField, 0, len(invalid))
+		for _, fieldErr := range invalid {
+			fields = append(fields, ProblemField{Field: fieldErr.Field(), Message: validationMessage(fieldErr)})
+		}
+
+		return &requestError{message: "request is invalid", fields: fields}
+	}
+
+	return nil
+}
+
+func decodeParams(r *http.Request, value reflect.Value) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+
+		if field.Anonymous && value.Field(i).Kind() == reflect.Struct {
+			if err := decodeParams(r, value.Field(i)); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if !field.IsExported() {
+			continue
+		}
+
+		source, name, values := paramValues(r, field)
+		if source == "" {
+			continue
+		}
+
+		value.Field(i).Set(reflect.Zero(field.Type))
+
+		if len(values) == 0 {
+			continue
+		}
+
+		if err := setField(value.Field(i), values); err != nil {
+			return &requestError{
+				message: "request is invalid",
+				fields: []ProblemField{
+					{Field: name, Message: fmt.Sprintf("invalid %s parameter", source)},
+				},
+			}
+		}
+	}
+
+	return nil
+}
+
+func paramValues(r *http.Request, field reflect.StructField) (string, string, []string) {
+	if name := field.Tag.Get(pathTag); name != "" {
+		if param := chi.URLParam(r, name); param != "" {
+			return pathTag, name, []string{param}
+		}
+
+		return pathTag, name, nil
+	}
+
+	if name := field.Tag.Get(queryTag); name != "" {
+		return queryTag, name, r.URL.Query()[name]
+	}
+
+	if name := field.Tag.Get(headerTag); name != "" {
+		return headerTag, name, r.Header.Values(name)
+	}
+
+	return "", "", nil
+}
+
+// setField sets field from values. Fields can be strings, booleans, numbers, durations, types implementing
+// encoding.TextUnmarshaler such as time.Time, pointers to those and, for repeated parameters, slices of those.
+func setField(field reflect.Value, values []string) error {
+	if field.Kind() == reflect.Slice && field.Type().Elem().Kind() != reflect.Uint8 {
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, v := range values {
+			if err := setValue(slice.Index(i), v); err != nil {
+				return err
+			}
+		}
+
+		field.Set(slice)
+
+		return nil
+	}
+
+	return setValue(field, values[0])
+}
+
+func setValue(field reflect.Value, value string) error {
+	if field.Kind() == reflect.Ptr {
+		ptr := reflect.New(field.Type().Elem())
+		if err := setValue(ptr.Elem(), value); err != nil {
+			return err
+		}
+
+		field.Set(ptr)
+
+		return nil
+	}
+
+	if reflect.PointerTo(field.Type()).Implements(textUnmarshalerType) {
+		return field.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(value))
+	}
+
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+
+		field.SetBool(b)
+	case field.CanInt():
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		field.SetInt(n)
+	case field.CanUint():
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		field.SetUint(n)
+	case field.CanFloat():
+		n, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+
+		field.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
+
+// newValidator returns a validator that names fields the way clients send them.
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		for _, tag := range []string{pathTag, queryTag, headerTag, "json"} {
+			name, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+			if name == "-" {
+				return ""
+			}
+
+			if name != "" {
+				return name
+			}
+		}
+
+		return field.Name
+	})
+
+	return v
+}
+
+func validationMessage(fieldErr validator.FieldError) string {
+	if fieldErr.Param() == "" {
+		return fieldErr.Tag()
+	}
+
+	return fmt.Sprintf("%s=%s", fieldErr.Tag(), fieldErr.Param())
+}
+
+// jsonErrorMessage describes err without echoing Go type names back to the client.
+func jsonErrorMessage(err error) string {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return fmt.Sprintf("%s has the wrong type", typeErr.Field)
+	}
+
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return fmt.Sprintf("malformed JSON at offset %d", syntaxErr.Offset)
+	}
+
+	if strings.HasPrefix(err.Error(), "json: unknown field") {
+		return strings.TrimPrefix(err.Error(), "json: ")
+	}
+
+	return "malformed JSON"
+}
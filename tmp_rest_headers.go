@@ -0,0 +1,103 @@
+package rest
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/cors"
+	"go.uber.org/zap"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+// newCORS returns the CORS handler described by cfg. The API key header, and the tenant header when the tenant is
+// read from one, are always allowed so that browsers can authenticate the way other clients do.
+func newCORS(cfg *corsConfig, auth *authConfig, tenant *tenantConfig) *cors.Cors {
+	if len(cfg.AllowedOrigins) == 0 {
+		log.Fatalf("failed to configure CORS: %q", "CORS_ALLOWED_ORIGINS is required when CORS is enabled")
+	}
+
+	if cfg.AllowCredentials && contains(cfg.AllowedOrigins, "*") {
+		log.Fatalf("failed to configure CORS: %q", "credentials cannot be allowed for every origin")
+	}
+
+	headers := append([]string{}, cfg.AllowedHeaders...)
+	headers = append(headers, auth.APIKeyHeader)
+
+	if tenant.Source == "header" {
+		headers = append(headers, tenant.Header)
+	}
+
+	return cors.New(cors.Options{
+		AllowedOrigins:   cfg.AllowedOrigins,
+		AllowedMethods:   cfg.AllowedMethods,
+		AllowedHeaders:   headers,
+		ExposedHeaders:   cfg.ExposedHeaders,
+		AllowCredentials: cfg.AllowCredentials,
+		MaxAge:           int(cfg.MaxAge.Seconds()),
+	})
+}
+
+// serverCORSMiddleware answers preflight requests and adds the CORS headers to the responses of allowed origins.
+// It runs before authentication since browsers send preflight requests without credentials.
+func serverCORSMiddleware(c *cors.Cors, log *logging.Logger) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		log.Debug("use server CORS middleware")
+		return c.Handler(next)
+	}
+}
+
+// securityHeaders returns the security headers of cfg with contentSecurityPolicy, so that routes such as the docs
+// UI can relax the policy of the API.
+func securityHeaders(cfg *securityHeadersConfig, contentSecurityPolicy string) http.Header {
+	headers := http.Header{}
+
+	headers.Set("X-Content-Type-Options", "nosniff")
+
+	if cfg.HSTSMaxAge > 0 {
+		hsts := []string{fmt.Sprintf("max-age=%d", int(cfg.HSTSMaxAge.Seconds()))}
+		if cfg.HSTSIncludeSubdomains {
+			hsts = append(hsts, "includeSubDomains")
+		}
+
+		if cfg.HSTSPreload {
+			hsts = append(hsts, "preload")
+		}
+
+		headers.Set("Strict-Transport-Security", strings.Join(hsts, "; "))
+	}
+
+	if contentSecurityPolicy != "" {
+		headers.Set("Content-Security-Policy", contentSecurityPolicy)
+	}
+
+	if cfg.ReferrerPolicy != "" {
+		headers.Set("Referrer-Policy", cfg.ReferrerPolicy)
+	}
+
+	if cfg.FrameOptions != "" {
+		headers.Set("X-Frame-Options", cfg.FrameOptions)
+	}
+
+	return headers
+}
+
+// serverSecurityHeadersMiddleware sets headers on every response. Set on a route, it replaces the headers set for
+// the whole router.
+func serverSecurityHeadersMiddleware(headers http.Header, log *logging.Logger) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			for key, values := range headers {
+				w.Header()[key] = values
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		log.Debug("use server security headers middleware", zap.Int("headers", len(headers)))
+		return http.HandlerFunc(fn)
+	}
+}
@@ -0,0 +1,418 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// IdempotencyRecord is what an IdempotencyStore holds for a key: the fingerprint of the request that reserved it
+	// and, once that request completed, its response. Status is 0 while the request is in flight.
+	IdempotencyRecord struct {
+		Fingerprint string      `json:"fingerprint"`
+		Status      int         `json:"status,omitempty"`
+		Header      http.Header `json:"header,omitempty"`
+		Body        []byte      `json:"body,omitempty"`
+	}
+
+	memoryIdempotencyStore struct {
+		mutex     sync.Mutex
+		records   map[string]*memoryIdempotencyRecord
+		lastSweep time.Time
+	}
+
+	memoryIdempotencyRecord struct {
+		record    *IdempotencyRecord
+		expiresAt time.Time
+	}
+
+	redisIdempotencyStore struct {
+		client *redis.Client
+	}
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+
+	idempotencyBackendMemory = "memory"
+	idempotencyBackendRedis  = "redis"
+
+	// idempotencyKeyMaxLength keeps clients from filling the store with arbitrarily large keys.
+	idempotencyKeyMaxLength = 255
+
+	rejectedByIdempotency = "idempotency"
+
+	reasonInFlight        = "in_flight"
+	reasonPayloadMismatch = "payload_mismatch"
+
+	idempotencyKeyPrefix = "idempotency:"
+
+	// memoryIdempotencyStoreSweepInterval is how often expired records are dropped.
+	memoryIdempotencyStoreSweepInterval = time.Minute
+)
+
+// redisIdempotencyBegin reserves KEYS[1] with ARGV[1] for ARGV[2] milliseconds, or returns the record it holds.
+var redisIdempotencyBegin = redis.NewScript(`
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return false
+end
+
+return redis.call("GET", KEYS[1])
+`)
+
+// idempotencyStore returns the store of stores that serves backend.
+func idempotencyStore(backend string, stores []IdempotencyStore) IdempotencyStore {
+	for _, store := range stores {
+		if store.Backend() == backend {
+			return store
+		}
+	}
+
+	log.Fatalf("failed to create idempotency store: no store for backend %q", backend)
+
+	return nil
+}
+
+// Backend implements IdempotencyStore.
+func (store *memoryIdempotencyStore) Backend() string {
+	return idempotencyBackendMemory
+}
+
+// Begin implements IdempotencyStore.
+func (store *memoryIdempotencyStore) Begin(
+	_ context.Context,
+	key, fingerprint string,
+	lockTimeout time.Duration,
+) (*IdempotencyRecord, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	store.sweep(now)
+
+	if held, ok := store.records[key]; ok && now.Before(held.expiresAt) {
+		record := *held.record
+		return &record, nil
+	}
+
+	store.records[key] = &memoryIdempotencyRecord{
+		record:    &IdempotencyRecord{Fingerprint: fingerprint},
+		expiresAt: now.Add(lockTimeout),
+	}
+
+	return nil, nil
+}
+
+// Complete implements IdempotencyStore.
+func (store *memoryIdempotencyStore) Complete(
+	_ context.Context,
+	key string,
+	record *IdempotencyRecord,
+	ttl time.Duration,
+) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.records[key] = &memoryIdempotencyRecord{record: record, expiresAt: time.Now().Add(ttl)}
+
+	return nil
+}
+
+// Release implements IdempotencyStore.
+func (store *memoryIdempotencyStore) Release(_ context.Context, key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.records, key)
+
+	return nil
+}
+
+func (store *memoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(store.lastSweep) < memoryIdempotencyStoreSweepInterval {
+		return
+	}
+
+	store.lastSweep = now
+
+	for key, held := range store.records {
+		if !now.Before(held.expiresAt) {
+			delete(store.records, key)
+		}
+	}
+}
+
+// Backend implements IdempotencyStore.
+func (store *redisIdempotencyStore) Backend() string {
+	return idempotencyBackendRedis
+}
+
+// Begin implements IdempotencyStore.
+func (store *redisIdempotencyStore) Begin(
+	ctx context.Context,
+	key, fingerprint string,
+	lockTimeout time.Duration,
+) (*IdempotencyRecord, error) {
+	value, err := json.Marshal(&IdempotencyRecord{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, err
+	}
+
+	held, err := redisIdempotencyBegin.Run(
+		ctx,
+		store.client,
+		[]string{idempotencyKeyPrefix + key},
+		value,
+		lockTimeout.Milliseconds(),
+	).Text()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	record := new(IdempotencyRecord)
+	if err := json.Unmarshal([]byte(held), record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// Complete implements IdempotencyStore.
+func (store *redisIdempotencyStore) Complete(
+	ctx context.Context,
+	key string,
+	record *IdempotencyRecord,
+	ttl time.Duration,
+) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return store.client.Set(ctx, idempotencyKeyPrefix+key, value, ttl).Err()
+}
+
+// Release implements IdempotencyStore.
+func (store *redisIdempotencyStore) Release(ctx context.Context, key string) error {
+	return store.client.Del(ctx, idempotencyKeyPrefix+key).Err()
+}
+
+// idempotencyFingerprint hashes what makes two requests the same: the method, the path, the query and the body.
+func idempotencyFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+
+	for _, part := range []string{r.Method, r.URL.Path, r.URL.RawQuery} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+
+	hash.Write(body)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// idempotencyStoreKey scopes key to route and to the caller, so that clients cannot replay each other's responses.
+func idempotencyStoreKey(r *http.Request, route, key string) string {
+	caller := "anonymous"
+	if principal, ok := PrincipalFromContext(r.Context()); ok {
+		caller = principal.Method + ":" + principal.KeyID + ":" + principal.Subject
+	}
+
+	if id, ok := tenant.FromContext(r.Context()); ok {
+		caller = id + "|" + caller
+	}
+
+	return r.Method + " " + route + "|" + caller + "|" + key
+}
+
+// serverIdempotencyMiddleware makes the unsafe methods of route idempotent for requests sent with an Idempotency-Key
+// header. The first request with a key runs and its response is stored for IDEMPOTENCY_TTL; retries get that
+// response back with Idempotent-Replayed: true. A retry sent while the first request runs gets a 409 and a retry
+// with the key of another request a 422. Responses with a 5xx status are not stored, so those requests can be
+// retried.
+func serverIdempotencyMiddleware(
+	cfg *idempotencyConfig,
+	route string,
+	store IdempotencyStore,
+	collector *telemetry.MetricsCollector,
+	log *logging.Logger,
+) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if isSafeMethod(r.Method) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := r.Header.Get(idempotencyKeyHeader)
+			if key == "" {
+				if cfg.Required {
+					writeProblem(w, r, NewProblem(http.StatusBadRequest, "the Idempotency-Key header is required"))
+					return
+				}
+
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if len(key) > idempotencyKeyMaxLength {
+				writeProblem(w, r, NewProblem(
+					http.StatusBadRequest,
+					fmt.Sprintf("the Idempotency-Key header is longer than %d characters", idempotencyKeyMaxLength),
+				))
+
+				return
+			}
+
+			body, err := readBody(r)
+			if err != nil {
+				writeError(w, r, log, err)
+				return
+			}
+
+			storeKey := idempotencyStoreKey(r, route, key)
+			fingerprint := idempotencyFingerprint(r, body)
+
+			held, err := store.Begin(r.Context(), storeKey, fingerprint, cfg.LockTimeout)
+			if err != nil {
+				log.Error("failed to reserve idempotency key", zap.String("route", route), zap.Error(err))
+				writeProblem(w, r, NewProblem(http.StatusServiceUnavailable, "idempotency keys are unavailable"))
+
+				return
+			}
+
+			if held != nil {
+				replayIdempotentResponse(w, r, held, fingerprint, collector)
+				return
+			}
+
+			recorder := &recordingResponseWriter{header: http.Header{}}
+			completed := false
+
+			defer func() {
+				if completed {
+					return
+				}
+
+				if err := store.Release(context.WithoutCancel(r.Context()), storeKey); err != nil {
+					log.Error("failed to release idempotency key", zap.String("route", route), zap.Error(err))
+				}
+			}()
+
+			next.ServeHTTP(recorder, r)
+
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+
+			if recorder.status < http.StatusInternalServerError {
+				record := &IdempotencyRecord{
+					Fingerprint: fingerprint,
+					Status:      recorder.status,
+					Header:      recorder.header,
+					Body:        recorder.body.Bytes(),
+				}
+
+				err := store.Complete(context.WithoutCancel(r.Context()), storeKey, record, cfg.TTL)
+				if err != nil {
+					log.Error("failed to store idempotent response", zap.String("route", route), zap.Error(err))
+				}
+
+				completed = err == nil
+			}
+
+			recorder.flush(w)
+		}
+
+		log.Debug("use server idempotency middleware", zap.String("route", route), zap.String("store", store.Backend()))
+		return http.HandlerFunc(fn)
+	}
+}
+
+func replayIdempotentResponse(
+	w http.ResponseWriter,
+	r *http.Request,
+	held *IdempotencyRecord,
+	fingerprint string,
+	collector *telemetry.MetricsCollector,
+) {
+	switch {
+	case held.Fingerprint != fingerprint:
+		collector.RecordRejectedMetric(rejectedByIdempotency, reasonPayloadMismatch)
+		writeProblem(w, r, NewProblem(
+			http.StatusUnprocessableEntity,
+			"the Idempotency-Key was used for a different request",
+		))
+	case held.Status == 0:
+		collector.RecordRejectedMetric(rejectedByIdempotency, reasonInFlight)
+		w.Header().Set("Retry-After", "1")
+		writeProblem(w, r, NewProblem(
+			http.StatusConflict,
+			"a request with the same Idempotency-Key is in progress",
+		))
+	default:
+		for key, values := range held.Header {
+			w.Header()[key] = values
+		}
+
+		w.Header().Set(idempotencyReplayedHeader, "true")
+		w.WriteHeader(held.Status)
+
+		_, _ = w.Write(held.Body)
+	}
+}
+
+// readBody reads the body of r and puts it back so that the handler can read it too.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, NewError(
+				http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("request body is larger than %d bytes", maxBytesErr.Limit),
+				err,
+			)
+		}
+
+		return nil, NewError(http.StatusBadRequest, "failed to read request body", err)
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+
+	return false
+}
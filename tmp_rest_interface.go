@@ -1,10 +1,49 @@
 package rest
 
 import (
+	"context"
 	"net/http"
+	"time"
 )
 
 // Endpoint defines a rest handler method.
 type Endpoint interface {
 	Handler() http.HandlerFunc
 }
+
+// AuthorizedEndpoint is an Endpoint that only callers holding the scopes or roles it lists may use.
+type AuthorizedEndpoint interface {
+	Endpoint
+	Authorization() Authorization
+}
+
+// DescribedEndpoint is an Endpoint that documents itself in the OpenAPI document.
+type DescribedEndpoint interface {
+	Endpoint
+	Operation() Operation
+}
+
+// CachedEndpoint is an Endpoint whose successful responses carry the Cache-Control policy it returns, for example
+// "private, max-age=60" or "no-store". Handlers that set Cache-Control themselves keep theirs.
+type CachedEndpoint interface {
+	Endpoint
+	CacheControl() string
+}
+
+// APIKeyStore finds API keys by id. It returns ErrAPIKeyNotFound when it does not hold the key. Backend names the
+// store for AUTH_API_KEY_BACKENDS.
+type APIKeyStore interface {
+	Backend() string
+	FindAPIKey(ctx context.Context, id string) (*APIKey, error)
+}
+
+// IdempotencyStore keeps the responses of requests sent with an Idempotency-Key. Begin reserves key for the request
+// with fingerprint until lockTimeout, unless key is already held, in which case it returns the record held. Complete
+// stores the response of the request for ttl and Release drops the reservation so that the request can be retried.
+// Backend names the store for IDEMPOTENCY_BACKEND.
+type IdempotencyStore interface {
+	Backend() string
+	Begin(ctx context.Context, key, fingerprint string, lockTimeout time.Duration) (*IdempotencyRecord, error)
+	Complete(ctx context.Context, key string, record *IdempotencyRecord, ttl time.Duration) error
+	Release(ctx context.Context, key string) error
+}
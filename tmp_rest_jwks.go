@@ -0,0 +1,291 @@
+package rest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// keySet holds the public keys used to verify RS256 and ES256 tokens. Keys come from a PEM file, a local JWKS
+	// file or a JWKS URL. Keys from a URL are refreshed every refreshInterval, and early when a token names a key
+	// id the set does not know, so that rotated keys are picked up without a restart.
+	keySet struct {
+		mutex           sync.RWMutex
+		refreshMutex    sync.Mutex
+		keys            map[string]interface{}
+		staticKey       interface{}
+		url             string
+		client          *http.Client
+		refreshInterval time.Duration
+		refreshedAt     time.Time
+		log             *logging.Logger
+	}
+
+	jsonWebKeySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	jsonWebKey struct {
+		KeyID   string `json:"kid"`
+		KeyType string `json:"kty"`
+		Use     string `json:"use"`
+		N       string `json:"n"`
+		E       string `json:"e"`
+		Curve   string `json:"crv"`
+		X       string `json:"x"`
+		Y       string `json:"y"`
+	}
+)
+
+const (
+	// minKeySetRefreshInterval stops tokens with made up key ids from making us hammer the JWKS URL.
+	minKeySetRefreshInterval = time.Minute
+	keySetRequestTimeout     = 10 * time.Second
+)
+
+var errUnknownKey = errors.New("unknown signing key")
+
+func newKeySet(cfg *authConfig, log *logging.Logger) (*keySet, error) {
+	set := &keySet{
+		keys:            map[string]interface{}{},
+		url:             cfg.JWKSURL,
+		client:          &http.Client{Timeout: keySetRequestTimeout},
+		refreshInterval: cfg.JWKSRefreshInterval,
+		log:             log,
+	}
+
+	if cfg.JWTPublicKeyFile != "" {
+		key, err := readPublicKeyFile(cfg.JWTPublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		set.staticKey = key
+	}
+
+	if cfg.JWKSFile != "" {
+		content, err := os.ReadFile(cfg.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+
+		keys, err := parseJSONWebKeySet(content)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", cfg.JWKSFile, err)
+		}
+
+		set.keys = keys
+	}
+
+	if set.url != "" {
+		if err := set.refresh(context.Background()); err != nil {
+			// the JWKS endpoint may come up after us, lookups will retry
+			log.Error("failed to fetch JSON web key set", zap.String("url", set.url), zap.Error(err))
+		}
+	}
+
+	return set, nil
+}
+
+func (set *keySet) empty() bool {
+	return set.staticKey == nil && len(set.keys) == 0 && set.url == ""
+}
+
+// lookup returns the key with id kid, or the key from the PEM file when the token does not name a key.
+func (set *keySet) lookup(ctx context.Context, kid string) (interface{}, error) {
+	if kid == "" && set.staticKey != nil {
+		return set.staticKey, nil
+	}
+
+	set.mutex.RLock()
+	key, ok := set.keys[kid]
+	sinceRefresh := time.Since(set.refreshedAt)
+	set.mutex.RUnlock()
+
+	stale := sinceRefresh > set.refreshInterval
+	if set.url == "" || (ok && !stale) || (!ok && !stale && sinceRefresh < minKeySetRefreshInterval) {
+		return set.found(key, ok)
+	}
+
+	if err := set.refresh(ctx); err != nil {
+		set.log.Error("failed to refresh JSON web key set", zap.String("url", set.url), zap.Error(err))
+	}
+
+	set.mutex.RLock()
+	key, ok = set.keys[kid]
+	set.mutex.RUnlock()
+
+	return set.found(key, ok)
+}
+
+func (set *keySet) found(key interface{}, ok bool) (interface{}, error) {
+	if ok {
+		return key, nil
+	}
+
+	if set.staticKey != nil {
+		return set.staticKey, nil
+	}
+
+	return nil, errUnknownKey
+}
+
+func (set *keySet) refresh(ctx context.Context) error {
+	set.refreshMutex.Lock()
+	defer set.refreshMutex.Unlock()
+
+	set.mutex.Lock()
+	if !set.refreshedAt.IsZero() && time.Since(set.refreshedAt) < time.Second {
+		// another request refreshed the set while this one waited
+		set.mutex.Unlock()
+		return nil
+	}
+
+	// record the attempt up front so that a failing endpoint is not retried by every request
+	set.refreshedAt = time.Now()
+	set.mutex.Unlock()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, set.url, http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	response, err := set.client.Do(request)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = response.Body.Close()
+	}()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJSONWebKeySet(content)
+	if err != nil {
+		return err
+	}
+
+	set.mutex.Lock()
+	set.keys = keys
+	set.mutex.Unlock()
+
+	return nil
+}
+
+func parseJSONWebKeySet(content []byte) (map[string]interface{}, error) {
+	var set jsonWebKeySet
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			// skip key types we cannot verify with, the set may hold keys meant for other consumers
+			continue
+		}
+
+		keys[jwk.KeyID] = key
+	}
+
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.KeyType)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(decoded), nil
+}
+
+func readPublicKeyFile(path string) (interface{}, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM encoded key", path)
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
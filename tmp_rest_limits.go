@@ -0,0 +1,162 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// requestLimits are the deadline and the body size cap of the requests to a route; zero means no limit.
+	requestLimits struct {
+		timeout      time.Duration
+		maxBodyBytes int64
+	}
+
+	// limitedBody is a request body capped by http.MaxBytesReader, it calls exceeded the first time the cap is hit.
+	limitedBody struct {
+		io.ReadCloser
+
+		once     sync.Once
+		exceeded func()
+	}
+)
+
+const (
+	rejectedByLimits = "limits"
+
+	reasonBodyTooLarge     = "body_too_large"
+	reasonDeadlineExceeded = "deadline_exceeded"
+)
+
+// parseRequestLimits parses <timeout>/<max body bytes>, for example "30s/10485760".
+func parseRequestLimits(value string) (requestLimits, error) {
+	timeout, maxBodyBytes, ok := strings.Cut(value, "/")
+	if !ok {
+		return requestLimits{}, fmt.Errorf("request limits %q are not <timeout>/<max body bytes>", value)
+	}
+
+	t, err := time.ParseDuration(timeout)
+	if err != nil || t < 0 {
+		return requestLimits{}, fmt.Errorf("request limits %q have an invalid timeout", value)
+	}
+
+	b, err := strconv.ParseInt(maxBodyBytes, 10, 64)
+	if err != nil || b < 0 {
+		return requestLimits{}, fmt.Errorf("request limits %q have an invalid body size", value)
+	}
+
+	return requestLimits{timeout: t, maxBodyBytes: b}, nil
+}
+
+// routeRequestLimits returns the limits configured for route in HTTP_ROUTE_LIMITS, or the default limits.
+func routeRequestLimits(cfg *httpConfig, route string) requestLimits {
+	limits := requestLimits{timeout: cfg.RequestTimeout, maxBodyBytes: cfg.MaxBodyBytes}
+
+	if value, ok := cfg.RouteLimits[route]; ok {
+		var err error
+		if limits, err = parseRequestLimits(value); err != nil {
+			log.Fatalf("failed to load request limits for %s: %q", route, err)
+		}
+	}
+
+	if cfg.WriteTimeout > 0 && limits.timeout >= cfg.WriteTimeout {
+		log.Fatalf(
+			"failed to load request limits for %s: %q",
+			route,
+			"the request timeout must be shorter than HTTP_WRITE_TIMEOUT",
+		)
+	}
+
+	return limits
+}
+
+// Read implements io.Reader interface.
+func (body *limitedBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		body.once.Do(body.exceeded)
+	}
+
+	return n, err
+}
+
+// serverLimitsMiddleware caps the request body and gives the request a deadline. Bodies declared larger than the cap
+// are rejected with a 413 before the handler runs, others fail to read past it and Handle answers 413 too. Handlers
+// must pass the request context on for the deadline to stop their work; a request still unanswered when it passes
+// is answered with a 503.
+func serverLimitsMiddleware(
+	limits requestLimits,
+	route string,
+	collector *telemetry.MetricsCollector,
+	log *logging.Logger,
+) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if limits.maxBodyBytes > 0 && r.Body != nil && r.Body != http.NoBody {
+				if r.ContentLength > limits.maxBodyBytes {
+					collector.RecordRejectedMetric(rejectedByLimits, reasonBodyTooLarge)
+
+					writeProblem(w, r, NewProblem(
+						http.StatusRequestEntityTooLarge,
+						fmt.Sprintf("request body is larger than %d bytes", limits.maxBodyBytes),
+					))
+
+					return
+				}
+
+				r.Body = &limitedBody{
+					ReadCloser: http.MaxBytesReader(w, r.Body, limits.maxBodyBytes),
+					exceeded: func() {
+						collector.RecordRejectedMetric(rejectedByLimits, reasonBodyTooLarge)
+					},
+				}
+			}
+
+			// WebSocket connections last as long as their clients stay, the timeout is for requests
+			if limits.timeout <= 0 || isWebSocketUpgrade(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), limits.timeout)
+			defer cancel()
+
+			r = r.WithContext(ctx)
+			rw := &responseWriter{ResponseWriter: w}
+
+			next.ServeHTTP(rw, r)
+
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				collector.RecordRejectedMetric(rejectedByLimits, reasonDeadlineExceeded)
+
+				if rw.Code() == 0 {
+					writeProblem(w, r, NewProblem(http.StatusServiceUnavailable, deadlineExceededDetail))
+				}
+			}
+		}
+
+		log.Debug(
+			"use server limits middleware",
+			zap.String("route", route),
+			zap.Duration("timeout", limits.timeout),
+			zap.Int64("max_body_bytes", limits.maxBodyBytes),
+		)
+
+		return http.HandlerFunc(fn)
+	}
+}
@@ -3,49 +3,152 @@ package rest
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/go-chi/chi"
 	"github.com/gofrs/uuid"
 	"github.com/pkg/errors"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
     {{range .imports}}
 	"{{.}}"
 	{{- end}}
 )
 
+const (
+	tenantSourceHeader    = "header"
+	tenantSourceSubdomain = "subdomain"
+	tenantSourceClaim     = "claim"
+
+	// unmatchedRoute stands for every path no route matched, so that they share one metric label.
+	unmatchedRoute = "unmatched"
+
+	maxRequestIDLength = 128
+
+	panicSourceHTTP = "http"
+)
+
+// routePattern returns the pattern of the route that matched r, for example /users/{id}, or unmatchedRoute. The
+// pattern is only known once r has been routed: after next returns in middleware used by the router itself.
+func routePattern(r *http.Request) string {
+	if routeContext := chi.RouteContext(r.Context()); routeContext != nil {
+		if pattern := routeContext.RoutePattern(); pattern != "" {
+			return pattern
+		}
+	}
+
+	return unmatchedRoute
+}
+
+// serverRecoveryMiddleware answers requests whose handler panicked with a 500 problem instead of dropping the
+// connection, after reporting the panic with telemetry.ReportPanic. A response that has already started cannot be
+// answered with a problem, it is aborted instead. http.ErrAbortHandler is passed on, it is how handlers ask the
+// server to abort a response.
+func serverRecoveryMiddleware(
+	collector *telemetry.MetricsCollector,
+	log *logging.Logger,
+) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			rw := &responseWriter{ResponseWriter: w}
+
+			defer func() {
+				rec := recover()
+				if rec == nil {
+					return
+				}
+
+				if rec == http.ErrAbortHandler { //nolint:errorlint
+					panic(rec)
+				}
+
+				telemetry.ReportPanic(
+					r.Context(),
+					log.Logger,
+					collector,
+					panicSourceHTTP,
+					rec,
+					zap.String("http_method", r.Method),
+					zap.String("http_url", r.URL.Path),
+					zap.String("http_route", routePattern(r)),
+				)
+
+				if rw.Code() != 0 {
+					panic(http.ErrAbortHandler)
+				}
+
+				writeProblem(rw, r, NewProblem(http.StatusInternalServerError, ""))
+			}()
+
+			next.ServeHTTP(rw, r)
+		}
+
+		log.Debug("use server recovery middleware")
+		return http.HandlerFunc(fn)
+	}
+}
+
+// serverTracingMiddleware starts the span of the request. The span, and the server span of otelhttp above it, are
+// named after the method and the route pattern once the request has been routed.
+//
+// The request id and the correlation id of the request are taken from X-Request-ID and X-Correlation-ID when they
+// are valid, see validRequestID. Without a correlation id the trace id of a valid W3C traceparent is used, so that
+// the id matches the trace the caller started, and a new one is made otherwise. Both ids are echoed in the response
+// headers and put in the context, the httpclient round trippers forward them on outbound calls.
 func serverTracingMiddleware(log *logging.Logger) func(handler http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
 			rw := &responseWriter{ResponseWriter: w}
 
-			ctx, span := otel.Tracer("api-server").Start(r.Context(), r.URL.Path)
+			serverSpan := trace.SpanFromContext(r.Context())
+
+			ctx, span := otel.Tracer("api-server").Start(r.Context(), r.Method)
 			defer span.End()
 
-			requestID := r.Header.Get("X-Request-ID")
-			if requestID == "" {
-				id := uuid.Must(uuid.NewV4())
-				requestID = id.String()
-				r.Header.Add("X-Request-ID", requestID)
+			requestID, ok := validRequestID(r.Header.Get(logging.RequestIDHeader))
+			if !ok {
+				requestID = uuid.Must(uuid.NewV4()).String()
+			}
+
+			correlationID, ok := validRequestID(r.Header.Get(logging.CorrelationIDHeader))
+			if !ok {
+				correlationID = incomingTraceID(r)
+			}
+
+			if correlationID == "" {
+				correlationID = uuid.Must(uuid.NewV4()).String()
 			}
 
-			corID := uuid.Must(uuid.NewV4())
+			r.Header.Set(logging.RequestIDHeader, requestID)
+			r.Header.Set(logging.CorrelationIDHeader, correlationID)
+			w.Header().Set(logging.RequestIDHeader, requestID)
+			w.Header().Set(logging.CorrelationIDHeader, correlationID)
 
-			ctx = context.WithValue(ctx, apiRequestID, requestID)
-			ctx = context.WithValue(ctx, logging.CorrelationID, corID)
+			ctx = context.WithValue(ctx, logging.RequestID, requestID)
+			ctx = context.WithValue(ctx, logging.CorrelationID, correlationID)
 			ctx = context.WithValue(ctx, apiTraceID, span.SpanContext().TraceID())
 			ctx = context.WithValue(ctx, apiSpanID, span.SpanContext().SpanID())
 
-			span.SetName(r.URL.Path)
 			span.SetAttributes(
 				attribute.String("request_id", requestID),
-				attribute.String("correlation_id", corID.String()),
+				attribute.String("correlation_id", correlationID),
 			)
 
 			next.ServeHTTP(rw, r.WithContext(ctx))
 
+			route := routePattern(r)
+			for _, s := range []trace.Span{span, serverSpan} {
+				s.SetName(r.Method + " " + route)
+				s.SetAttributes(attribute.String("http.route", route))
+			}
+
 			if rw.Code() >= http.StatusBadRequest {
 				err := errors.New(fmt.Sprintf("unsuccessful api request: %d", rw.Code()))
 
@@ -72,14 +175,15 @@ func serverMetricsMiddleware(
 
 			next.ServeHTTP(rw, r)
 
-			collector.RecordHTTPLatencyMetricWithLabels(
-				startTime,
-				telemetry.NewHTTPMetricLabels(r.Method, r.URL.Path, rw.Code()),
-			)
+			labels := telemetry.NewHTTPMetricLabels(r.Method, routePattern(r), rw.Code())
 
-			collector.RecordHTTPMetric(
-				telemetry.NewHTTPMetricLabels(r.Method, r.URL.Path, rw.Code()),
-			)
+			// streams and WebSocket connections last as long as their clients stay connected, their duration is not
+			// a latency
+			if !isStream(rw.Header()) && rw.Code() != http.StatusSwitchingProtocols {
+				collector.RecordHTTPLatencyMetricWithLabels(startTime, labels)
+			}
+
+			collector.RecordHTTPMetric(labels)
 		}
 
 		log.Debug("use server metrics middleware")
@@ -87,16 +191,207 @@ func serverMetricsMiddleware(
 	}
 }
 
-func serverAuthUserMiddleware(log *logging.Logger) func(handler http.Handler) http.Handler {
+func serverAuthUserMiddleware(
+	auth *authenticator,
+	collector *telemetry.MetricsCollector,
+	audit *logging.Logger,
+	log *logging.Logger,
+) func(handler http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
-			ctx := r.Context()
-			rw := &responseWriter{ResponseWriter: w}
+			if auth.config.Disabled {
+				next.ServeHTTP(w, r)
+				return
+			}
 
-			next.ServeHTTP(rw, r.WithContext(ctx))
+			principal, failure := auth.authenticate(r)
+			if failure != nil {
+				collector.RecordRejectedMetric(rejectedByAuth, failure.reason)
+
+				if failure.keyID != "" {
+					audit.Info(
+						"api key rejected",
+						zap.String("key_id", failure.keyID),
+						zap.String("reason", failure.reason),
+						zap.String("http_url", r.URL.Path),
+						logging.CorrelationIDField(logging.GetCorrelationIDFromCtx(r.Context())),
+					)
+				}
+
+				if failure.err != nil {
+					log.Error("failed to find api key", zap.String("key_id", failure.keyID), zap.Error(failure.err))
+				}
+
+				log.Info(
+					"request authentication failed",
+					zap.String("reason", failure.reason),
+					logging.CorrelationIDField(logging.GetCorrelationIDFromCtx(r.Context())),
+				)
+
+				if failure.status() == http.StatusUnauthorized {
+					w.Header().Set("WWW-Authenticate", auth.challenge(failure))
+				}
+
+				writeProblem(w, r, NewProblem(failure.status(), failure.description))
+				return
+			}
+
+			principalSpanAttributes(r.Context(), principal)
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiPrincipal, principal)))
+		}
+
+		log.Debug("use server auth middleware", zap.Bool("disabled", auth.config.Disabled))
+		return http.HandlerFunc(fn)
+	}
+}
+
+// serverAuthorizationMiddleware rejects callers that do not hold what authorization requires with a 403. Every
+// decision is written to the audit log; API key secrets never reach it, only key ids.
+func serverAuthorizationMiddleware(
+	authorization Authorization,
+	route string,
+	cfg *authConfig,
+	collector *telemetry.MetricsCollector,
+	audit *logging.Logger,
+) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if cfg.Disabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			principal, ok := PrincipalFromContext(r.Context())
+			if !ok {
+				principal = new(Principal)
+			}
+
+			reason := authorization.check(principal)
+
+			fields := []zap.Field{
+				zap.String("route", route),
+				zap.String("http_method", r.Method),
+				zap.String("subject", principal.Subject),
+				zap.String("auth_method", principal.Method),
+				zap.Strings("required_scopes", authorization.Scopes),
+				zap.Strings("required_roles", authorization.Roles),
+				logging.CorrelationIDField(logging.GetCorrelationIDFromCtx(r.Context())),
+			}
+
+			if principal.KeyID != "" {
+				fields = append(fields, zap.String("key_id", principal.KeyID))
+			}
+
+			if reason != "" {
+				collector.RecordRejectedMetric(rejectedByAuthorization, reason)
+				audit.Info("access denied", append(fields, zap.String("reason", reason))...)
+
+				writeProblem(w, r, NewProblem(http.StatusForbidden, strings.ReplaceAll(reason, "_", " ")))
+				return
+			}
+
+			audit.Info("access granted", fields...)
+
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+func serverTenantMiddleware(cfg *tenantConfig, log *logging.Logger) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			id := tenantFromRequest(cfg, r)
+			if id == "" {
+				if cfg.Required {
+					writeProblem(w, r, NewProblem(http.StatusBadRequest, tenant.ErrMissing.Error()))
+					return
+				}
+
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if err := tenant.Validate(id); err != nil {
+				writeProblem(w, r, NewProblem(http.StatusBadRequest, err.Error()))
+				return
+			}
+
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("tenant", id))
+
+			next.ServeHTTP(w, r.WithContext(tenant.NewContext(r.Context(), id)))
 		}
 
-		log.Debug("use server auth middleware")
+		log.Debug("use server tenant middleware", zap.String("source", cfg.Source))
 		return http.HandlerFunc(fn)
 	}
 }
+
+func tenantFromRequest(cfg *tenantConfig, r *http.Request) string {
+	switch cfg.Source {
+	case tenantSourceHeader:
+		return strings.ToLower(strings.TrimSpace(r.Header.Get(cfg.Header)))
+	case tenantSourceSubdomain:
+		return tenantFromHost(cfg.Domain, r.Host)
+	case tenantSourceClaim:
+		if principal, ok := PrincipalFromContext(r.Context()); ok {
+			id, _ := principal.Claims[cfg.Claim].(string)
+			return strings.ToLower(id)
+		}
+	}
+
+	return ""
+}
+
+// tenantFromHost returns the subdomain of host right under domain, or an empty string when host is not one. IP
+// addresses, domain itself and deeper subdomains hold no tenant.
+func tenantFromHost(domain, host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+
+	subdomain, ok := strings.CutSuffix(host, "."+strings.ToLower(strings.Trim(domain, ".")))
+	if !ok || subdomain == "" || strings.Contains(subdomain, ".") {
+		return ""
+	}
+
+	return subdomain
+}
+
+// validRequestID returns id trimmed when it can be used as a request or correlation id: at most 128 letters, digits
+// and "-", "_", ".", ":" characters. Anything else is dropped rather than echoed to logs and other services.
+func validRequestID(id string) (string, bool) {
+	id = strings.TrimSpace(id)
+	if id == "" || len(id) > maxRequestIDLength {
+		return "", false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', strings.ContainsRune("-_.:", c):
+		default:
+			return "", false
+		}
+	}
+
+	return id, true
+}
+
+// incomingTraceID returns the trace id of the W3C traceparent header of r, or an empty string when it has none or
+// it is not valid.
+func incomingTraceID(r *http.Request) string {
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.HeaderCarrier(r.Header))
+
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		return spanContext.TraceID().String()
+	}
+
+	return ""
+}
@@ -0,0 +1,520 @@
+package rest
+
+import (
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// Operation documents an endpoint in the OpenAPI document. Create it with Describe so that it knows the
+	// request and response types of the endpoint.
+	Operation struct {
+		Summary     string
+		Description string
+		Tags        []string
+		request     reflect.Type
+		response    reflect.Type
+	}
+
+	// OpenAPI is the OpenAPI 3.1 document of the API, generated from the endpoints registered with the server.
+	OpenAPI struct {
+		OpenAPI    string                                  `json:"openapi" yaml:"openapi"`
+		Info       openAPIInfo                             `json:"info" yaml:"info"`
+		Paths      map[string]map[string]*openAPIOperation `json:"paths" yaml:"paths"`
+		Components openAPIComponents                       `json:"components" yaml:"components"`
+	}
+
+	openAPIInfo struct {
+		Title   string `json:"title" yaml:"title"`
+		Version string `json:"version" yaml:"version"`
+	}
+
+	openAPIComponents struct {
+		Schemas         map[string]schema `json:"schemas" yaml:"schemas"`
+		SecuritySchemes map[string]schema `json:"securitySchemes" yaml:"securitySchemes"`
+	}
+
+	openAPIOperation struct {
+		OperationID string                `json:"operationId" yaml:"operationId"`
+		Summary     string                `json:"summary,omitempty" yaml:"summary,omitempty"`
+		Description string                `json:"description,omitempty" yaml:"description,omitempty"`
+		Tags        []string              `json:"tags,omitempty" yaml:"tags,omitempty"`
+		Parameters  []schema              `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+		RequestBody schema                `json:"requestBody,omitempty" yaml:"requestBody,omitempty"`
+		Responses   map[string]schema     `json:"responses" yaml:"responses"`
+		Security    []map[string][]string `json:"security,omitempty" yaml:"security,omitempty"`
+	}
+
+	// schema is a JSON schema, or any other OpenAPI object that is easiest to write as a map.
+	schema map[string]interface{}
+
+	route struct {
+		method   string
+		pattern  string
+		endpoint Endpoint
+	}
+
+	schemaGenerator struct {
+		schemas map[string]schema
+		// types are the types the schema names were given to, so that two types never share a schema.
+		types map[string]reflect.Type
+	}
+)
+
+const (
+	openAPIVersion    = "3.1.0"
+	apiVersion        = "1.0.0"
+	bearerAuthScheme  = "bearerAuth"
+	apiKeyAuthScheme  = "apiKeyAuth"
+	problemSchemaName = "Problem"
+)
+
+var (
+	routeParamPattern = regexp.MustCompile(`\{([^}:]+):[^}]+\}`)
+	packagePattern    = regexp.MustCompile(`(?:[\w-]+[./])+`)
+	nonWordPattern    = regexp.MustCompile(`[^A-Za-z0-9]+`)
+	timeType          = reflect.TypeOf(time.Time{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// Describe returns the Operation of an endpoint whose handler is Handle with a func(ctx, Req) (Resp, error).
+func Describe[Req any, Resp any](summary string) Operation {
+	return Operation{
+		Summary:  summary,
+		request:  reflect.TypeOf((*Req)(nil)).Elem(),
+		response: reflect.TypeOf((*Resp)(nil)).Elem(),
+	}
+}
+
+// OpenAPI returns the OpenAPI document of the endpoints registered with the server.
+func (server *APIServer) OpenAPI() *OpenAPI {
+	server.openAPIOnce.Do(func() {
+		server.openAPI = newOpenAPI(server.routes, server.config)
+	})
+
+	return server.openAPI
+}
+
+// JSON returns the document encoded as JSON.
+func (document *OpenAPI) JSON() ([]byte, error) {
+	return json.MarshalIndent(document, "", "  ")
+}
+
+// YAML returns the document encoded as YAML.
+func (document *OpenAPI) YAML() ([]byte, error) {
+	return yaml.Marshal(document)
+}
+
+func (server *APIServer) serveOpenAPI(contentType string, encode func(*OpenAPI) ([]byte, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		content, err := encode(server.OpenAPI())
+		if err != nil {
+			writeError(w, r, server.log, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		_, _ = w.Write(content)
+	}
+}
+
+func newOpenAPI(routes []route, cfg *config) *OpenAPI {
+	generator := &schemaGenerator{schemas: map[string]schema{}, types: map[string]reflect.Type{}}
+	generator.schema(reflect.TypeOf(Problem{}))
+
+	document := &OpenAPI{
+		OpenAPI: openAPIVersion,
+		Info:    openAPIInfo{Title: "{{.serviceName}}", Version: apiVersion},
+		Paths:   map[string]map[string]*openAPIOperation{},
+		Components: openAPIComponents{
+			Schemas: generator.schemas,
+			SecuritySchemes: map[string]schema{
+				bearerAuthScheme: {"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				apiKeyAuthScheme: {"type": "apiKey", "in": "header", "name": cfg.Auth.APIKeyHeader},
+			},
+		},
+	}
+
+	for _, route := range routes {
+		described, ok := route.endpoint.(DescribedEndpoint)
+		if !ok {
+			continue
+		}
+
+		// OpenAPI paths have no regular expressions, {id:[0-9]+} becomes {id}
+		route.pattern = routeParamPattern.ReplaceAllString(route.pattern, "{$1}")
+		if document.Paths[route.pattern] == nil {
+			document.Paths[route.pattern] = map[string]*openAPIOperation{}
+		}
+
+		document.Paths[route.pattern][strings.ToLower(route.method)] = generator.operation(
+			route,
+			described.Operation(),
+			cfg,
+		)
+	}
+
+	return document
+}
+
+func (generator *schemaGenerator) operation(route route, operation Operation, cfg *config) *openAPIOperation {
+	op := &openAPIOperation{
+		OperationID: operationID(route),
+		Summary:     operation.Summary,
+		Description: operation.Description,
+		Tags:        operation.Tags,
+		Parameters:  generator.parameters(operation.request),
+		Responses:   map[string]schema{},
+	}
+
+	switch route.method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		if hasBody(operation.request) {
+			op.RequestBody = schema{
+				"required": true,
+				"content":  schema{"application/json": schema{"schema": generator.schema(operation.request)}},
+			}
+		}
+	}
+
+	status := http.StatusOK
+	if coder, ok := reflect.Zero(operation.response).Interface().(StatusCoder); ok {
+		status = coder.StatusCode()
+	}
+
+	success := schema{"description": http.StatusText(status)}
+	if status != http.StatusNoContent {
+		success["content"] = schema{"application/json": schema{"schema": generator.schema(operation.response)}}
+	}
+
+	op.Responses[strconv.Itoa(status)] = success
+
+	problems := []int{http.StatusBadRequest, http.StatusInternalServerError}
+
+	if !cfg.Auth.Disabled {
+		var scopes []string
+		if authorized, ok := route.endpoint.(AuthorizedEndpoint); ok {
+			scopes = authorized.Authorization().Scopes
+			problems = append(problems, http.StatusForbidden)
+		}
+
+		op.Security = []map[string][]string{
+			{bearerAuthScheme: nonNil(scopes)},
+			{apiKeyAuthScheme: nonNil(scopes)},
+		}
+		problems = append(problems, http.StatusUnauthorized)
+	}
+
+	if cfg.RateLimit.Enabled {
+		problems = append(problems, http.StatusTooManyRequests)
+	}
+
+	for _, status := range problems {
+		op.Responses[strconv.Itoa(status)] = schema{
+			"description": http.StatusText(status),
+			"content": schema{
+				problemContentType: schema{"schema": schema{"$ref": "#/components/schemas/" + problemSchemaName}},
+			},
+		}
+	}
+
+	return op
+}
+
+// parameters returns the path, query and header parameters of the request type t.
+func (generator *schemaGenerator) parameters(t reflect.Type) []schema {
+	var parameters []schema
+
+	for _, field := range fields(t) {
+		for _, in := range []string{pathTag, queryTag, headerTag} {
+			name := field.Tag.Get(in)
+			if name == "" {
+				continue
+			}
+
+			fieldSchema := generator.schema(field.Type)
+			applyValidation(fieldSchema, field.Tag.Get("validate"))
+
+			parameters = append(parameters, schema{
+				"name":     name,
+				"in":       in,
+				"required": in == pathTag || isRequired(field),
+				"schema":   fieldSchema,
+			})
+		}
+	}
+
+	return parameters
+}
+
+// schema returns the JSON schema of t. Named structs are added to the components and referenced.
+func (generator *schemaGenerator) schema(t reflect.Type) schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return schema{"type": "string", "format": "date-time"}
+	case t == durationType:
+		return schema{"type": "integer", "description": "duration in nanoseconds"}
+	case t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType):
+		return schema{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return schema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return schema{"type": "string", "contentEncoding": "base64"}
+		}
+
+		return schema{"type": "array", "items": generator.schema(t.Elem())}
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": generator.schema(t.Elem())}
+	case reflect.Struct:
+		return generator.structSchema(t)
+	default:
+		return schema{}
+	}
+}
+
+func (generator *schemaGenerator) structSchema(t reflect.Type) schema {
+	name := generator.name(t)
+	if name != "" {
+		if _, ok := generator.schemas[name]; ok {
+			return schema{"$ref": "#/components/schemas/" + name}
+		}
+
+		// reserve the name first, so that recursive types reference themselves instead of looping
+		generator.schemas[name] = schema{}
+	}
+
+	properties := map[string]schema{}
+	required := []string{}
+	response := !hasValidation(t)
+
+	for _, field := range fields(t) {
+		if field.Tag.Get(pathTag) != "" || field.Tag.Get(queryTag) != "" || field.Tag.Get(headerTag) != "" {
+			continue
+		}
+
+		jsonName, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if jsonName == "-" {
+			continue
+		}
+
+		if jsonName == "" {
+			jsonName = field.Name
+		}
+
+		fieldSchema := generator.schema(field.Type)
+		applyValidation(fieldSchema, field.Tag.Get("validate"))
+		properties[jsonName] = fieldSchema
+
+		// requests say what they need with validate tags, responses always hold the fields that are not omitempty
+		if isRequired(field) || (response && field.Type.Kind() != reflect.Ptr && !strings.Contains(options, "omitempty")) {
+			required = append(required, jsonName)
+		}
+	}
+
+	sort.Strings(required)
+
+	structSchema := schema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		structSchema["required"] = required
+	}
+
+	if name == "" {
+		return structSchema
+	}
+
+	generator.schemas[name] = structSchema
+
+	return schema{"$ref": "#/components/schemas/" + name}
+}
+
+// fields returns the exported fields of struct t, with the fields of embedded structs in place of the struct.
+func fields(t reflect.Type) []reflect.StructField {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var list []reflect.StructField
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		switch {
+		case field.Anonymous && field.Type.Kind() == reflect.Struct && field.Tag.Get("json") == "":
+			list = append(list, fields(field.Type)...)
+		case field.IsExported():
+			list = append(list, field)
+		}
+	}
+
+	return list
+}
+
+// applyValidation adds the constraints of the validate tag that JSON schema can express.
+func applyValidation(fieldSchema schema, tag string) {
+	for _, rule := range strings.Split(tag, ",") {
+		name, param, _ := strings.Cut(rule, "=")
+
+		switch name {
+		case "email", "uuid", "uri", "url", "hostname", "ipv4", "ipv6":
+			fieldSchema["format"] = name
+		case "oneof":
+			fieldSchema["enum"] = strings.Fields(param)
+		case "min", "max", "len", "gte", "lte":
+			value, err := strconv.ParseFloat(param, 64)
+			if err != nil {
+				continue
+			}
+
+			for _, keyword := range limitKeywords(fieldSchema["type"], name) {
+				fieldSchema[keyword] = value
+			}
+		}
+	}
+}
+
+func limitKeywords(schemaType interface{}, rule string) []string {
+	lower, upper := "minimum", "maximum"
+
+	switch schemaType {
+	case "string":
+		lower, upper = "minLength", "maxLength"
+	case "array":
+		lower, upper = "minItems", "maxItems"
+	case "object":
+		lower, upper = "minProperties", "maxProperties"
+	}
+
+	switch rule {
+	case "min", "gte":
+		return []string{lower}
+	case "max", "lte":
+		return []string{upper}
+	default:
+		return []string{lower, upper}
+	}
+}
+
+func isRequired(field reflect.StructField) bool {
+	for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+		if rule == "required" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasBody reports whether the request type t has fields that are read from the JSON body.
+func hasBody(t reflect.Type) bool {
+	for _, field := range fields(t) {
+		if field.Tag.Get(pathTag) == "" && field.Tag.Get(queryTag) == "" && field.Tag.Get(headerTag) == "" &&
+			field.Tag.Get("json") != "-" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasValidation(t reflect.Type) bool {
+	for _, field := range fields(t) {
+		if field.Tag.Get("validate") != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// name returns the schema name of named type t, or an empty string for anonymous types. Types of different
+// packages with the same name are told apart by their package, for example DomainOrder, and by a number after that.
+func (generator *schemaGenerator) name(t reflect.Type) string {
+	base := schemaName(t)
+	if base == "" {
+		return ""
+	}
+
+	candidates := []string{base, schemaName(t, path.Base(t.PkgPath()))}
+
+	for i := 2; ; i++ {
+		for _, name := range candidates {
+			claimed, ok := generator.types[name]
+			if !ok || claimed == t {
+				generator.types[name] = t
+				return name
+			}
+		}
+
+		candidates = []string{candidates[1] + strconv.Itoa(i)}
+	}
+}
+
+// schemaName returns the name of t in PascalCase, preceded by prefixes and followed by the type arguments of
+// instantiated generic types without their packages, for example PageOrder for page[example.com/api/rest.order]
+// and PageListOrder for page[[]example.com/api/rest.order].
+func schemaName(t reflect.Type, prefixes ...string) string {
+	if t.Name() == "" {
+		return ""
+	}
+
+	var name strings.Builder
+
+	words := append(prefixes, strings.ReplaceAll(packagePattern.ReplaceAllString(t.Name(), ""), "[]", "List "))
+	for _, word := range nonWordPattern.Split(strings.Join(words, " "), -1) {
+		if word != "" {
+			name.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+
+	return name.String()
+}
+
+// operationID returns an id such as getExampleEndpoint for GET /example-endpoint.
+func operationID(route route) string {
+	id := strings.ToLower(route.method)
+
+	for _, part := range strings.FieldsFunc(route.pattern, func(r rune) bool {
+		return r == '/' || r == '-' || r == '_' || r == '{' || r == '}' || r == '.'
+	}) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+
+	return id
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+
+	return values
+}
@@ -0,0 +1,78 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.opentelemetry.io/otel/trace"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// Problem is the body of every error response, see RFC 7807. Type is a URI that identifies the kind of problem,
+	// about:blank when the status code says it all.
+	Problem struct {
+		Type      string         `json:"type"`
+		Title     string         `json:"title"`
+		Status    int            `json:"status"`
+		Detail    string         `json:"detail,omitempty"`
+		Instance  string         `json:"instance,omitempty"`
+		RequestID string         `json:"request_id,omitempty"`
+		TraceID   string         `json:"trace_id,omitempty"`
+		Errors    []ProblemField `json:"errors,omitempty"`
+	}
+
+	// ProblemField describes one invalid field of a request.
+	ProblemField struct {
+		Field   string `json:"field"`
+		Message string `json:"message"`
+	}
+)
+
+const (
+	problemContentType = "application/problem+json"
+	problemTypeBlank   = "about:blank"
+)
+
+// NewProblem returns a Problem for status with the standard title.
+func NewProblem(status int, detail string) *Problem {
+	return &Problem{
+		Type:   problemTypeBlank,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// writeProblem sends problem, adding the path, request id and trace id of r.
+func writeProblem(w http.ResponseWriter, r *http.Request, problem *Problem) {
+	problem.Instance = r.URL.Path
+
+	if requestID := logging.GetRequestIDFromCtx(r.Context()); requestID != "" {
+		problem.RequestID = requestID
+	} else {
+		problem.RequestID = r.Header.Get(logging.RequestIDHeader)
+	}
+
+	if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.HasTraceID() {
+		problem.TraceID = spanContext.TraceID().String()
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+
+	_ = json.NewEncoder(w).Encode(problem)
+}
+
+// serverNotFoundHandler answers requests for routes that do not exist.
+func serverNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, NewProblem(http.StatusNotFound, "no route matches the request path"))
+}
+
+// serverMethodNotAllowedHandler answers requests for routes that exist with another method.
+func serverMethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, NewProblem(http.StatusMethodNotAllowed, "the route does not accept the request method"))
+}
@@ -0,0 +1,352 @@
+package rest
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// rateLimit is a token bucket that holds up to burst tokens and refills at rate tokens per second.
+	rateLimit struct {
+		rate  float64
+		burst int
+	}
+
+	rateLimitResult struct {
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+		reset      time.Duration
+	}
+
+	rateLimiter interface {
+		allow(ctx context.Context, key string, limit rateLimit) (rateLimitResult, error)
+	}
+
+	memoryRateLimiter struct {
+		mutex     sync.Mutex
+		buckets   map[string]*tokenBucket
+		lastSweep time.Time
+	}
+
+	tokenBucket struct {
+		tokens    float64
+		updatedAt time.Time
+		fullAt    time.Time
+	}
+
+	redisRateLimiter struct {
+		client *redis.Client
+	}
+
+	// clientIdentifier tells clients apart: by API key, then by token subject, then by IP address.
+	clientIdentifier struct {
+		trustedProxies []*net.IPNet
+	}
+)
+
+const (
+	rateLimitBackendMemory = "memory"
+	rateLimitBackendRedis  = "redis"
+
+	rejectedByRateLimit = "rate_limit"
+
+	rateLimitKeyPrefix = "ratelimit:"
+
+	// memoryRateLimiterSweepInterval is how often buckets that have been full for a while are dropped.
+	memoryRateLimiterSweepInterval = time.Minute
+)
+
+// redisTokenBucket takes one token from the bucket stored at KEYS[1], refilling it first for the time passed since
+// it was last updated. It runs as a script so that concurrent requests on different instances see one bucket.
+var redisTokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "updated_at")
+local tokens = tonumber(bucket[1])
+local updated_at = tonumber(bucket[2])
+
+if tokens == nil then
+	tokens = burst
+	updated_at = now
+end
+
+tokens = math.min(burst, tokens + (math.max(0, now - updated_at) / 1000) * rate)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tokens, "updated_at", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst / rate) * 1000) + 1000)
+
+return {allowed, tostring(tokens)}
+`)
+
+func newRateLimiter(cfg *rateLimitConfig) rateLimiter {
+	switch cfg.Backend {
+	case rateLimitBackendMemory:
+		return &memoryRateLimiter{buckets: map[string]*tokenBucket{}, lastSweep: time.Now()}
+	case rateLimitBackendRedis:
+		if cfg.RedisServer == "" {
+			log.Fatalf("failed to create rate limiter: REDIS_SERVER is not set")
+		}
+
+		return &redisRateLimiter{client: redis.NewClient(&redis.Options{Addr: cfg.RedisServer})}
+	default:
+		log.Fatalf("failed to create rate limiter: unknown backend %q", cfg.Backend)
+	}
+
+	return nil
+}
+
+func newClientIdentifier(cfg *rateLimitConfig) *clientIdentifier {
+	identifier := new(clientIdentifier)
+
+	for _, cidr := range cfg.TrustedProxies {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			log.Fatalf("failed to parse trusted proxy %q: %q", cidr, err)
+		}
+
+		identifier.trustedProxies = append(identifier.trustedProxies, network)
+	}
+
+	return identifier
+}
+
+// parseRateLimit reads a limit written as <requests per second>/<burst>, for example 5/10.
+func parseRateLimit(value string) (rateLimit, error) {
+	rate, burst, ok := strings.Cut(value, "/")
+	if !ok {
+		return rateLimit{}, fmt.Errorf("rate limit %q is not <rate>/<burst>", value)
+	}
+
+	r, err := strconv.ParseFloat(rate, 64)
+	if err != nil || r <= 0 {
+		return rateLimit{}, fmt.Errorf("rate limit %q has an invalid rate", value)
+	}
+
+	b, err := strconv.Atoi(burst)
+	if err != nil || b < 1 {
+		return rateLimit{}, fmt.Errorf("rate limit %q has an invalid burst", value)
+	}
+
+	return rateLimit{rate: r, burst: b}, nil
+}
+
+// routeRateLimit returns the limit configured for route in RATE_LIMIT_ROUTES, or the default limit.
+func routeRateLimit(cfg *rateLimitConfig, route string) rateLimit {
+	value, ok := cfg.Routes[route]
+	if !ok {
+		return rateLimit{rate: cfg.Rate, burst: cfg.Burst}
+	}
+
+	limit, err := parseRateLimit(value)
+	if err != nil {
+		log.Fatalf("failed to load rate limit for %s: %q", route, err)
+	}
+
+	return limit
+}
+
+// identify returns the key the caller of r is rate limited by and the kind of that key.
+func (identifier *clientIdentifier) identify(r *http.Request) (string, string) {
+	if principal, ok := PrincipalFromContext(r.Context()); ok {
+		switch {
+		case principal.KeyID != "":
+			return "key:" + principal.KeyID, "api_key"
+		case principal.Subject != "":
+			return "sub:" + principal.Subject, "subject"
+		}
+	}
+
+	return "ip:" + identifier.clientIP(r), "ip"
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only read when the request came through a trusted
+// proxy, and then from the right, so that a client cannot pick its own address by sending the header itself.
+func (identifier *clientIdentifier) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !identifier.trusted(host) {
+		return host
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwarded[i])
+		if address == "" {
+			continue
+		}
+
+		if !identifier.trusted(address) {
+			return address
+		}
+
+		host = address
+	}
+
+	return host
+}
+
+func (identifier *clientIdentifier) trusted(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range identifier.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (limiter *memoryRateLimiter) allow(_ context.Context, key string, limit rateLimit) (rateLimitResult, error) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	limiter.sweep(now)
+
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.burst), updatedAt: now}
+		limiter.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(float64(limit.burst), bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*limit.rate)
+	bucket.updatedAt = now
+
+	allowed := bucket.tokens >= 1
+	if allowed {
+		bucket.tokens--
+	}
+
+	bucket.fullAt = now.Add(time.Duration((float64(limit.burst) - bucket.tokens) / limit.rate * float64(time.Second)))
+
+	return limit.result(allowed, bucket.tokens), nil
+}
+
+// sweep drops buckets that have refilled completely, they behave exactly like a new bucket.
+func (limiter *memoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < memoryRateLimiterSweepInterval {
+		return
+	}
+
+	limiter.lastSweep = now
+
+	for key, bucket := range limiter.buckets {
+		if now.After(bucket.fullAt) {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+func (limiter *redisRateLimiter) allow(ctx context.Context, key string, limit rateLimit) (rateLimitResult, error) {
+	values, err := redisTokenBucket.Run(
+		ctx,
+		limiter.client,
+		[]string{rateLimitKeyPrefix + key},
+		limit.rate,
+		limit.burst,
+		time.Now().UnixMilli(),
+	).Slice()
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+
+	allowed, _ := values[0].(int64)
+
+	tokens, err := strconv.ParseFloat(fmt.Sprint(values[1]), 64)
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+
+	return limit.result(allowed == 1, tokens), nil
+}
+
+func (limit rateLimit) result(allowed bool, tokens float64) rateLimitResult {
+	result := rateLimitResult{
+		allowed:   allowed,
+		remaining: int(math.Floor(tokens)),
+		reset:     time.Duration((float64(limit.burst) - tokens) / limit.rate * float64(time.Second)),
+	}
+
+	if !allowed {
+		result.retryAfter = time.Duration((1 - tokens) / limit.rate * float64(time.Second))
+	}
+
+	return result
+}
+
+// serverRateLimitMiddleware limits callers of route to limit. It sets the RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers on every response and answers 429 with Retry-After once the caller's bucket is empty.
+// When the backend fails the request is let through, an unavailable limiter should not take the API down.
+func serverRateLimitMiddleware(
+	limit rateLimit,
+	route string,
+	limiter rateLimiter,
+	identifier *clientIdentifier,
+	collector *telemetry.MetricsCollector,
+	log *logging.Logger,
+) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			client, kind := identifier.identify(r)
+
+			result, err := limiter.allow(r.Context(), route+"|"+client, limit)
+			if err != nil {
+				log.Error("failed to check rate limit", zap.String("route", route), zap.Error(err))
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.burst))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.reset)))
+
+			if !result.allowed {
+				collector.RecordRejectedMetric(rejectedByRateLimit, kind)
+
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.retryAfter)))
+				writeProblem(w, r, NewProblem(http.StatusTooManyRequests, "rate limit exceeded, retry later"))
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
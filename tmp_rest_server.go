@@ -8,11 +8,13 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/cors"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
@@ -26,11 +28,25 @@ type (
 	APIServer struct {
 		*http.Server
 
-		router          *chi.Mux
-		config          *config
-		log             *logging.Logger
-		instrumentation *telemetry.Instrumentation
-		collector       *telemetry.MetricsCollector
+		router           *chi.Mux
+		config           *config
+		authenticator    *authenticator
+		rateLimiter      rateLimiter
+		clientIdentifier *clientIdentifier
+		contract         *contract
+		cors             *cors.Cors
+		compression      *compression
+		idempotencyStore IdempotencyStore
+		certificates     *certificateReloader
+		admin            *adminServer
+		drain            *drainTracker
+		log              *logging.Logger
+		audit            *logging.Logger
+		instrumentation  *telemetry.Instrumentation
+		collector        *telemetry.MetricsCollector
+		routes           []route
+		openAPIOnce      sync.Once
+		openAPI          *OpenAPI
 	}
 
 	apiRequestLogger struct {
@@ -46,72 +62,142 @@ type (
 )
 
 const (
-	apiRequestID     = logging.ContextKey("apiRequestID")
 	apiTraceID       = logging.ContextKey("apiTraceID")
 	apiSpanID        = logging.ContextKey("apiSpanID")
-
-	timeout = time.Second * 10
+	apiPrincipal     = logging.ContextKey("apiPrincipal")
 )
 
-func (server *APIServer) haltOnSignal(ctx context.Context, signal <-chan os.Signal) {
-	<-signal
-
-	timeOutctx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-
-	server.log.Info("shutting down REST API server")
-
-	if err := server.instrumentation.TraceProvider().Shutdown(timeOutctx); err != nil {
-		server.log.Fatal("REST API server shutdown did not complete successfully", zap.Error(err))
-	}
-
-	if err := server.Shutdown(timeOutctx); err != nil {
-		server.log.Fatal("REST API server shutdown did not complete successfully", zap.Error(err))
-	}
-}
-
 func (server *APIServer) withMetrics(name string) *APIServer {
 	server.collector = telemetry.NewMetricsCollector(
 		name,
 		telemetry.TotalOperations(),
 		telemetry.TotalHTTPOperationsWithLabels(),
 		telemetry.HTTPLatencyWithLabels(),
+		telemetry.RejectionsWithLabels(),
+		telemetry.WebSocketsWithLabels(),
+		telemetry.PanicsWithLabels(),
 	)
 
 	server.instrumentation.Registry().MustRegister(
 		server.collector.Counter(),
 		server.collector.CounterVec(),
 		server.collector.LatencyVec(),
+		server.collector.RejectVec(),
+		server.collector.SocketVec(),
+		server.collector.MessageVec(),
+		server.collector.PanicVec(),
 	)
 
 	return server
 }
 
-// BootstrapAPIServer starts up the API server.
+// handle registers the handler of endpoint for method and pattern, behind the rate limit configured for pattern.
+// Endpoints that implement AuthorizedEndpoint are also registered behind the authorization they declare, and those
+// that implement CachedEndpoint send the Cache-Control policy they declare. Requests are validated against the
+// OpenAPI document once the rate and request limits have let them through.
+func (server *APIServer) handle(r chi.Router, method, pattern string, endpoint Endpoint) {
+	if server.rateLimiter != nil {
+		r = r.With(serverRateLimitMiddleware(
+			routeRateLimit(server.config.RateLimit, pattern),
+			pattern,
+			server.rateLimiter,
+			server.clientIdentifier,
+			server.collector,
+			server.log,
+		))
+	}
+
+	if authorized, ok := endpoint.(AuthorizedEndpoint); ok {
+		r = r.With(serverAuthorizationMiddleware(
+			authorized.Authorization(),
+			pattern,
+			server.config.Auth,
+			server.collector,
+			server.audit,
+		))
+	}
+
+	r = r.With(serverLimitsMiddleware(
+		routeRequestLimits(server.config.HTTP, pattern),
+		pattern,
+		server.collector,
+		server.log,
+	))
+
+	cacheControl := ""
+	if cached, ok := endpoint.(CachedEndpoint); ok {
+		cacheControl = cached.CacheControl()
+	}
+
+	r = r.With(serverConditionalMiddleware(server.config.Conditional, cacheControl, server.log))
+
+	// validation reads the body, so it comes after the rate limit and the body size limit
+	if server.contract != nil {
+		r = r.With(serverContractMiddleware(server.contract, server.log))
+	}
+
+	if server.idempotencyStore != nil && contains(server.config.Idempotency.Routes, pattern) {
+		r = r.With(serverIdempotencyMiddleware(
+			server.config.Idempotency,
+			pattern,
+			server.idempotencyStore,
+			server.collector,
+			server.log,
+		))
+	}
+
+	r.Method(method, pattern, endpoint.Handler())
+
+	server.routes = append(server.routes, route{method: method, pattern: pattern, endpoint: endpoint})
+}
+
+// BootstrapAPIServer starts up the API server and runs it until the process is interrupted or terminated, then
+// shuts it down gracefully and exits.
 func BootstrapAPIServer(ctx context.Context, server *APIServer, address string) {
 	server.Addr = address
 
 	server.Handler = otelhttp.NewHandler(server.router, "")
+	server.BaseContext = func(net.Listener) context.Context {
+		return context.WithValue(ctx, apiDrain, server.drain.stopped)
+	}
 
 	stop := make(chan os.Signal, 1)
 
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
-	go server.haltOnSignal(ctx, stop)
+	serverErr := make(chan error, 2)
+
+	if server.admin != nil {
+		go server.admin.serve(serverErr)
+	}
 
-	serverErr := make(chan error, 1)
 	go func() {
+		if server.certificates != nil {
+			if server.config.TLS.ReloadInterval > 0 {
+				go server.certificates.watch(ctx)
+			}
+
+			server.log.Debug(fmt.Sprintf("starting REST API server with TLS on port %s", server.Addr))
+			serverErr <- server.ListenAndServeTLS("", "")
+
+			return
+		}
+
 		server.log.Debug(fmt.Sprintf("starting REST API server on port %s", server.Addr))
 		serverErr <- server.ListenAndServe()
 	}()
 
 	select {
 	case <-stop:
-		server.log.Info("graceful shutdown of REST API server")
-		os.Exit(0)
+		os.Exit(server.shutdown(ctx, stop))
 	case err := <-serverErr:
 		server.log.Error("error occurred while listening to http requests", zap.Error(err))
-		os.Exit(1)
+
+		flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), server.config.Shutdown.TelemetryTimeout)
+		server.flushTelemetry(flushCtx)
+		cancel()
+
+		os.Exit(exitCodeServerError)
 	}
 }
 
@@ -148,12 +234,17 @@ func (r *responseWriter) Flush() {
 
 // Hijack implements http.ResponseWriter interface.
 func (r *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	hj, ok := r.ResponseWriter.(http.Hijacker)
-	if !ok {
-		return nil, nil, fmt.Errorf("the hijacker interface is not supported")
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, fmt.Errorf("the hijacker interface is not supported: %w", err)
 	}
 
-	return hj.Hijack()
+	return conn, rw, nil
+}
+
+// Unwrap returns the http.ResponseWriter wrapped, for http.ResponseController.
+func (r *responseWriter) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
 }
 
 // Code implements http.ResponseWriter interface.
@@ -169,15 +260,19 @@ func (r *responseWriter) Size() int {
 // NewLogEntry returns a new LogEntry.
 func (logger apiRequestLogger) NewLogEntry(request *http.Request) middleware.LogEntry {
 	ctx := request.Context()
+	tenantID, _ := tenant.FromContext(ctx)
 
 	return apiRequestLogger{
 		Log: logger.Log.With(
 			zap.String("http_method", request.Method),
 			zap.String("http_url", request.URL.Path),
+			zap.String("http_route", routePattern(request)),
 			zap.String("user_agent", request.UserAgent()),
-			zap.Any("request_id", ctx.Value(apiRequestID)),
+			zap.String("request_id", logging.GetRequestIDFromCtx(ctx)),
+			logging.CorrelationIDField(logging.GetCorrelationIDFromCtx(ctx)),
 			zap.Any("trace_id", ctx.Value(apiTraceID).(trace.TraceID)),
 			zap.Any("span_id", ctx.Value(apiSpanID).(trace.SpanID)),
+			logging.TenantField(tenantID),
 		),
 	}
 }
@@ -190,6 +285,8 @@ func (logger apiRequestLogger) Write(status, _ int, _ http.Header, elapsed time.
 	)
 
 	switch {
+	case status == http.StatusSwitchingProtocols:
+		l.Debug("Switched protocols")
 	case status >= 200 && status < 300:
 		l.Debug("Successful request")
 	case status < 400:
@@ -201,7 +298,8 @@ func (logger apiRequestLogger) Write(status, _ int, _ http.Header, elapsed time.
 	}
 }
 
-// Panic will make our apiRequestLogger panic.
+// Panic logs a panic the request recovered from. It does not panic again, serverRecoveryMiddleware answers the
+// request.
 func (logger apiRequestLogger) Panic(v interface{}, stack []byte) {
-	logger.Log.Panic(fmt.Sprintf("%+v", v), zap.String("stack", string(stack)))
+	logger.Log.Error(fmt.Sprintf("%+v", v), zap.String("stack", string(stack)))
 }
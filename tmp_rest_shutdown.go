@@ -0,0 +1,271 @@
+package rest
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nicklaw5/go-respond"
+	"go.uber.org/zap"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// drainTracker follows the requests and hijacked connections of the server while it shuts down. Server.Shutdown
+	// waits for requests but not for hijacked connections, websockets for example, so those are tracked here.
+	drainTracker struct {
+		draining atomic.Bool
+		requests atomic.Int64
+		stopped  chan struct{}
+		stopOnce sync.Once
+
+		mutex    sync.Mutex
+		hijacked map[net.Conn]struct{}
+	}
+
+	drainResponseWriter struct {
+		http.ResponseWriter
+
+		tracker *drainTracker
+	}
+
+	// hijackedConn removes itself from the tracker that handed it out when it is closed.
+	hijackedConn struct {
+		net.Conn
+
+		tracker   *drainTracker
+		closeOnce sync.Once
+	}
+)
+
+const (
+	apiDrain = logging.ContextKey("apiDrain")
+
+	// exitCodeServerError is returned when the server failed to listen, exitCodeIncompleteShutdown when requests were
+	// cut off at SHUTDOWN_DRAIN_TIMEOUT or telemetry could not be flushed.
+	exitCodeServerError        = 1
+	exitCodeIncompleteShutdown = 2
+
+	drainPollInterval = 50 * time.Millisecond
+)
+
+func newDrainTracker() *drainTracker {
+	return &drainTracker{stopped: make(chan struct{}), hijacked: map[net.Conn]struct{}{}}
+}
+
+// Draining returns a channel that is closed when the server stops accepting connections and drains the requests in
+// flight. Long-lived handlers, such as streams, select on it to end their response in time.
+func Draining(ctx context.Context) <-chan struct{} {
+	stopped, _ := ctx.Value(apiDrain).(chan struct{})
+
+	return stopped
+}
+
+// stop closes the channel returned by Draining.
+func (tracker *drainTracker) stop() {
+	tracker.stopOnce.Do(func() { close(tracker.stopped) })
+}
+
+func (tracker *drainTracker) track(conn net.Conn) net.Conn {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.hijacked[conn] = struct{}{}
+
+	return &hijackedConn{Conn: conn, tracker: tracker}
+}
+
+func (tracker *drainTracker) untrack(conn net.Conn) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	delete(tracker.hijacked, conn)
+}
+
+func (tracker *drainTracker) hijackedConnections() int {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	return len(tracker.hijacked)
+}
+
+// wait returns once the hijacked connections are closed, or with the error of ctx.
+func (tracker *drainTracker) wait(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for tracker.hijackedConnections() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// closeHijacked closes the hijacked connections still open.
+func (tracker *drainTracker) closeHijacked() {
+	tracker.mutex.Lock()
+	conns := make([]net.Conn, 0, len(tracker.hijacked))
+
+	for conn := range tracker.hijacked {
+		conns = append(conns, conn)
+	}
+	tracker.mutex.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.Close()
+		tracker.untrack(conn)
+	}
+}
+
+// Close implements net.Conn interface.
+func (conn *hijackedConn) Close() error {
+	conn.closeOnce.Do(func() { conn.tracker.untrack(conn.Conn) })
+
+	return conn.Conn.Close()
+}
+
+// Flush implements http.Flusher interface.
+func (w *drainResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker interface.
+func (w *drainResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return w.tracker.track(conn), rw, nil
+}
+
+// Unwrap returns the http.ResponseWriter wrapped, for http.ResponseController.
+func (w *drainResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// serverDrainMiddleware counts the requests in flight and tracks the connections hijacked by handlers.
+func serverDrainMiddleware(tracker *drainTracker, log *logging.Logger) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			tracker.requests.Add(1)
+			defer tracker.requests.Add(-1)
+
+			next.ServeHTTP(&drainResponseWriter{ResponseWriter: w, tracker: tracker}, r)
+		}
+
+		log.Debug("use server drain middleware")
+		return http.HandlerFunc(fn)
+	}
+}
+
+// readiness fails handler, the readiness probe, as soon as the server starts shutting down.
+func (server *APIServer) readiness(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if server.drain.draining.Load() {
+			respond.NewResponse(w).ServiceUnavailable(serverResponse{"status": "down"})
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// shutdown stops the server and returns the exit code of the process. Readiness fails first and the server keeps
+// serving for SHUTDOWN_PRE_STOP_DELAY, long enough for load balancers to take it out of rotation. The listener is
+// then closed, Draining is signalled and the requests and hijacked connections in flight get SHUTDOWN_DRAIN_TIMEOUT
+// to finish before they are cut off. The admin server stops after that and telemetry is flushed last, so that the
+// spans of drained requests are exported. A second signal exits at once.
+func (server *APIServer) shutdown(ctx context.Context, signals <-chan os.Signal) int {
+	cfg := server.config.Shutdown
+	done := make(chan struct{})
+
+	defer close(done)
+
+	go func() {
+		select {
+		case <-signals:
+			server.log.Warn("received a second signal, exiting without draining")
+			os.Exit(exitCodeIncompleteShutdown)
+		case <-done:
+		}
+	}()
+
+	code := 0
+
+	server.log.Info("shutting down REST API server", zap.Duration("pre_stop_delay", cfg.PreStopDelay))
+	server.drain.draining.Store(true)
+	server.SetKeepAlivesEnabled(false)
+
+	select {
+	case <-time.After(cfg.PreStopDelay):
+	case <-ctx.Done():
+	}
+
+	server.log.Info(
+		"draining REST API server",
+		zap.Int64("requests", server.drain.requests.Load()),
+		zap.Int("hijacked_connections", server.drain.hijackedConnections()),
+		zap.Duration("drain_timeout", cfg.DrainTimeout),
+	)
+	server.drain.stop()
+
+	drainCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cfg.DrainTimeout)
+	defer cancel()
+
+	err := server.Shutdown(drainCtx)
+	if err == nil {
+		err = server.drain.wait(drainCtx)
+	}
+
+	if err != nil {
+		server.log.Error(
+			"REST API server did not drain in time, cutting off the remaining requests",
+			zap.Int64("requests", server.drain.requests.Load()),
+			zap.Int("hijacked_connections", server.drain.hijackedConnections()),
+			zap.Error(err),
+		)
+
+		_ = server.Close()
+		server.drain.closeHijacked()
+		code = exitCodeIncompleteShutdown
+	}
+
+	telemetryCtx, cancelTelemetry := context.WithTimeout(context.WithoutCancel(ctx), cfg.TelemetryTimeout)
+	defer cancelTelemetry()
+
+	if server.admin != nil {
+		server.admin.shutdown(telemetryCtx)
+	}
+
+	if !server.flushTelemetry(telemetryCtx) {
+		code = exitCodeIncompleteShutdown
+	}
+
+	server.log.Info("REST API server shut down", zap.Int("exit_code", code))
+
+	return code
+}
+
+// flushTelemetry exports the spans still buffered and reports whether it succeeded.
+func (server *APIServer) flushTelemetry(ctx context.Context) bool {
+	if err := server.instrumentation.TraceProvider().Shutdown(ctx); err != nil {
+		server.log.Error("failed to flush telemetry", zap.Error(err))
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,167 @@
+package rest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+type (
+	// staticFile is a file served by StaticHandler with its encoded variants, made once at start up.
+	staticFile struct {
+		contentType string
+		etag        string
+		// encodings are the content codings of the variants kept, in order of preference.
+		encodings []string
+		variants  map[string][]byte
+	}
+
+	staticHandler struct {
+		files        map[string]*staticFile
+		cacheControl string
+	}
+)
+
+// staticEncodings are the content codings static files are compressed with, in order of preference.
+var staticEncodings = []string{encodingBrotli, encodingZstd, encodingGzip}
+
+// StaticHandler serves the files of fsys, such as assets embedded in the binary, with cacheControl as their
+// Cache-Control. The files are read once and compressed with every content coding, keeping the variants at least a
+// tenth smaller; requests get the variant negotiated with Accept-Encoding, with its own ETag so that ranges and
+// conditional requests apply to it. Paths ending in / serve their index.html.
+func StaticHandler(fsys fs.FS, cacheControl string) (http.Handler, error) {
+	handler := newStaticHandler(cacheControl)
+
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		return handler.add(fsys, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return handler, nil
+}
+
+func newStaticHandler(cacheControl string) *staticHandler {
+	return &staticHandler{files: map[string]*staticFile{}, cacheControl: cacheControl}
+}
+
+// add serves the files names of fsys under their names.
+func (handler *staticHandler) add(fsys fs.FS, names ...string) error {
+	for _, name := range names {
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+
+		file, err := newStaticFile(name, content)
+		if err != nil {
+			return err
+		}
+
+		handler.files["/"+name] = file
+	}
+
+	return nil
+}
+
+func newStaticFile(name string, content []byte) (*staticFile, error) {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(content)
+	}
+
+	sum := sha256.Sum256(content)
+
+	file := &staticFile{
+		contentType: contentType,
+		etag:        hex.EncodeToString(sum[:16]),
+		variants:    map[string][]byte{"": content},
+	}
+
+	for _, encoding := range staticEncodings {
+		encoded, err := encodeStatic(encoding, content)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(encoded) < len(content)*9/10 {
+			file.encodings = append(file.encodings, encoding)
+			file.variants[encoding] = encoded
+		}
+	}
+
+	return file, nil
+}
+
+func encodeStatic(encoding string, content []byte) ([]byte, error) {
+	newEncoder, err := encoderFactory(encoding, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	enc := newEncoder()
+	enc.Reset(&buf)
+
+	if _, err := enc.Write(content); err != nil {
+		return nil, err
+	}
+
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ServeHTTP implements http.Handler interface.
+func (handler *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path
+	if !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+
+	if strings.HasSuffix(name, "/") {
+		name += "index.html"
+	}
+
+	file, ok := handler.files[name]
+	if !ok {
+		serverNotFoundHandler(w, r)
+		return
+	}
+
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), file.encodings)
+
+	header := w.Header()
+	header.Set("Content-Type", file.contentType)
+	header.Set("ETag", `"`+file.etag+`"`)
+
+	if len(file.encodings) > 0 {
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+		header.Set("ETag", `"`+file.etag+"-"+encoding+`"`)
+	}
+
+	if handler.cacheControl != "" {
+		header.Set("Cache-Control", handler.cacheControl)
+	}
+
+	// embedded files have no modification time, the ETag validates them
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(file.variants[encoding]))
+}
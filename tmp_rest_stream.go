@@ -0,0 +1,334 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// Event is an event of a Server-Sent Events stream. Data is sent as is when it is a string or []byte and as JSON
+	// otherwise. Retry tells the client how long to wait before it reconnects.
+	Event struct {
+		ID    string
+		Name  string
+		Data  interface{}
+		Retry time.Duration
+	}
+
+	// EventStream writes Server-Sent Events to a client. It is safe for concurrent use.
+	EventStream struct {
+		// LastEventID is the id of the last event the client received before it reconnected, send the events
+		// that followed it first.
+		LastEventID string
+
+		mutex      sync.Mutex
+		w          http.ResponseWriter
+		controller *http.ResponseController
+	}
+)
+
+const (
+	eventStreamContentType = "text/event-stream"
+	ndjsonContentType      = "application/x-ndjson"
+
+	lastEventIDHeader = "Last-Event-ID"
+	errorEventName    = "error"
+
+	// eventStreamHeartbeatInterval is how often a comment is sent on a stream, so that proxies keep it open while
+	// no events are sent.
+	eventStreamHeartbeatInterval = 15 * time.Second
+)
+
+var errStreamingNotSupported = errors.New("streaming is not supported by the response writer")
+
+// HandleEventStream adapts fn to an http.HandlerFunc that answers with a Server-Sent Events stream. The request is
+// decoded into Req as by Handle. fn sends events on stream until it returns; a comment is sent every 15s to keep
+// the connection open. The context of fn is cancelled when the client disconnects or the server drains, so fn
+// must return then. A request that fails to decode is answered with a Problem; the stream has started when fn runs,
+// so an error it returns is sent as an error event.
+//
+// Streams last longer than HTTP_WRITE_TIMEOUT, which is lifted for them, but not longer than the request timeout of
+// their route, lift it with HTTP_ROUTE_LIMITS, for example "/events:0s/1024". OpenAPI response validation and
+// idempotency hold responses back and cannot be used with streams.
+func HandleEventStream[Req any](
+	log *logging.Logger,
+	fn func(ctx context.Context, req Req, stream *EventStream) error,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req Req
+
+		if err := decode(r, &req); err != nil {
+			writeError(w, r, log, err)
+			return
+		}
+
+		controller, err := startStream(w, eventStreamContentType)
+		if err != nil {
+			writeError(w, r, log, err)
+			return
+		}
+
+		stream := &EventStream{LastEventID: r.Header.Get(lastEventIDHeader), w: w, controller: controller}
+
+		ctx, cancel := streamContext(r)
+
+		var heartbeat sync.WaitGroup
+
+		heartbeat.Add(1)
+
+		go func() {
+			defer heartbeat.Done()
+			stream.heartbeat(ctx)
+		}()
+
+		// the heartbeat must not write to w once the handler has returned
+		defer func() {
+			cancel()
+			heartbeat.Wait()
+		}()
+
+		if err := fn(ctx, req, stream); err != nil && ctx.Err() == nil {
+			logStreamError(r, log, err)
+			_ = stream.Send(Event{Name: errorEventName, Data: errorProblem(err)})
+		}
+	}
+}
+
+// HandleNDJSON adapts fn to an http.HandlerFunc that streams the items fn returns as newline delimited JSON. The
+// request is decoded into Req as by Handle. Use ChannelItems to stream the values of a channel. Iteration stops
+// when the client disconnects or the server drains. An error returned by fn is sent as a Problem; an error yielded
+// by items ends the stream with a last line holding the problem under "error".
+//
+// See HandleEventStream for the limits that apply to streams.
+func HandleNDJSON[Req any, Item any](
+	log *logging.Logger,
+	fn func(ctx context.Context, req Req) (iter.Seq2[Item, error], error),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req Req
+
+		if err := decode(r, &req); err != nil {
+			writeError(w, r, log, err)
+			return
+		}
+
+		ctx, cancel := streamContext(r)
+		defer cancel()
+
+		items, err := fn(ctx, req)
+		if err != nil {
+			writeError(w, r, log, err)
+			return
+		}
+
+		controller, err := startStream(w, ndjsonContentType)
+		if err != nil {
+			writeError(w, r, log, err)
+			return
+		}
+
+		encoder := json.NewEncoder(w)
+
+		for item, err := range items {
+			if ctx.Err() != nil {
+				return
+			}
+
+			if err != nil {
+				logStreamError(r, log, err)
+				_ = encoder.Encode(map[string]interface{}{"error": errorProblem(err)})
+				_ = controller.Flush()
+
+				return
+			}
+
+			if err := encoder.Encode(item); err != nil {
+				return
+			}
+
+			if err := controller.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// ChannelItems returns an iterator over the values received from items until it is closed or ctx is done.
+func ChannelItems[Item any](ctx context.Context, items <-chan Item) iter.Seq2[Item, error] {
+	return func(yield func(Item, error) bool) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case item, ok := <-items:
+				if !ok || !yield(item, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Send writes event to the stream and flushes it to the client.
+func (stream *EventStream) Send(event Event) error {
+	data, err := eventData(event.Data)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+
+	if event.ID != "" {
+		fmt.Fprintf(&buf, "id: %s\n", singleLine(event.ID))
+	}
+
+	if event.Name != "" {
+		fmt.Fprintf(&buf, "event: %s\n", singleLine(event.Name))
+	}
+
+	if event.Retry > 0 {
+		fmt.Fprintf(&buf, "retry: %d\n", event.Retry.Milliseconds())
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+
+	buf.WriteByte('\n')
+
+	return stream.write(buf.Bytes())
+}
+
+// Comment writes a comment to the stream, clients ignore it.
+func (stream *EventStream) Comment(text string) error {
+	return stream.write([]byte(": " + singleLine(text) + "\n\n"))
+}
+
+func (stream *EventStream) write(b []byte) error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	if _, err := stream.w.Write(b); err != nil {
+		return err
+	}
+
+	return stream.controller.Flush()
+}
+
+func (stream *EventStream) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(eventStreamHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := stream.Comment("heartbeat"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// startStream sends the headers of a stream of contentType. HTTP_WRITE_TIMEOUT is lifted for the response.
+func startStream(w http.ResponseWriter, contentType string) (*http.ResponseController, error) {
+	if !canFlush(w) {
+		return nil, errStreamingNotSupported
+	}
+
+	controller := http.NewResponseController(w)
+
+	if err := controller.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return nil, err
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	// keeps nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	return controller, controller.Flush()
+}
+
+// streamContext returns the context of r, also cancelled when the server drains.
+func streamContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(r.Context())
+
+	go func() {
+		select {
+		case <-Draining(r.Context()):
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// canFlush reports whether the response writer under w can flush, and not only the wrappers around it.
+func canFlush(w http.ResponseWriter) bool {
+	for {
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			_, ok := w.(http.Flusher)
+			return ok
+		}
+
+		w = unwrapper.Unwrap()
+	}
+}
+
+// isStream reports whether header is the header of an event or NDJSON stream.
+func isStream(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+
+	return mediaType == eventStreamContentType || mediaType == ndjsonContentType
+}
+
+func eventData(data interface{}) (string, error) {
+	switch d := data.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return d, nil
+	case []byte:
+		return string(d), nil
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// singleLine keeps a field of an event on one line, a line break would end it.
+func singleLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+func logStreamError(r *http.Request, log *logging.Logger, err error) {
+	log.Error(
+		"stream failed",
+		zap.String("http_url", r.URL.Path),
+		zap.String("http_route", routePattern(r)),
+		zap.Error(err),
+	)
+}
@@ -0,0 +1,286 @@
+package rest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// certificateReloader serves the certificate and client CA bundle of the server from disk and loads them again
+	// when the files change, so that rotated secrets are picked up without a restart.
+	certificateReloader struct {
+		config *tlsConfig
+		log    *logging.Logger
+
+		mutex       sync.RWMutex
+		certificate *tls.Certificate
+		clientCAs   *x509.CertPool
+		versions    map[string]time.Time
+	}
+)
+
+const (
+	authMethodMTLS = "mtls"
+
+	tlsClientAuthNone          = "none"
+	tlsClientAuthVerifyIfGiven = "verify_if_given"
+	tlsClientAuthRequire       = "require"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// enabled reports whether the server serves TLS.
+func (cfg *tlsConfig) enabled() bool {
+	return cfg.CertFile != "" && cfg.KeyFile != ""
+}
+
+// verifiesClients reports whether the server verifies client certificates, which then authenticate requests.
+func (cfg *tlsConfig) verifiesClients() bool {
+	return cfg.enabled() && cfg.ClientAuth != tlsClientAuthNone
+}
+
+// checkTLSConfig stops the process when the TLS settings are only partly given, rather than serving plain HTTP.
+func checkTLSConfig(cfg *tlsConfig) {
+	if cfg.enabled() {
+		return
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		log.Fatalf("failed to configure TLS: TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	if cfg.ClientAuth != tlsClientAuthNone || cfg.ClientCAFile != "" {
+		log.Fatalf("failed to configure TLS: TLS_CLIENT_AUTH and TLS_CLIENT_CA_FILE need TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+}
+
+// newTLSConfig returns the TLS configuration of the server, with the certificates served by reloader.
+func newTLSConfig(cfg *tlsConfig, reloader *certificateReloader) *tls.Config {
+	version, ok := tlsVersions[cfg.MinVersion]
+	if !ok {
+		log.Fatalf("failed to configure TLS: unsupported minimum version %q", cfg.MinVersion)
+	}
+
+	config := &tls.Config{
+		MinVersion:     version,
+		CipherSuites:   cipherSuites(cfg.CipherSuites),
+		GetCertificate: reloader.getCertificate,
+	}
+
+	switch cfg.ClientAuth {
+	case tlsClientAuthNone:
+		return config
+	case tlsClientAuthVerifyIfGiven:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case tlsClientAuthRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		log.Fatalf("failed to configure TLS: unknown client auth %q", cfg.ClientAuth)
+	}
+
+	if cfg.ClientCAFile == "" {
+		log.Fatalf("failed to configure TLS: %q", "TLS_CLIENT_CA_FILE is required to verify client certificates")
+	}
+
+	// the client CA bundle can be rotated too, so every handshake gets the configuration with the current bundle
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		clientConfig := config.Clone()
+		clientConfig.GetConfigForClient = nil
+		clientConfig.ClientCAs = reloader.getClientCAs()
+
+		return clientConfig, nil
+	}
+
+	return config
+}
+
+// cipherSuites returns the ids of the cipher suites named in names. Go picks the suites of TLS 1.3 itself, these
+// only apply to TLS 1.2 connections; insecure suites are refused.
+func cipherSuites(names []string) []uint16 {
+	if len(names) == 0 {
+		return nil
+	}
+
+	suites := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+
+	for _, name := range names {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			log.Fatalf("failed to configure TLS: unknown or insecure cipher suite %q", name)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func newCertificateReloader(cfg *tlsConfig, logger *logging.Logger) *certificateReloader {
+	if cfg.ReloadInterval < 0 {
+		log.Fatalf(
+			"failed to configure TLS: TLS_RELOAD_INTERVAL %s is negative, use 0 to turn reloading off",
+			cfg.ReloadInterval,
+		)
+	}
+
+	reloader := &certificateReloader{config: cfg, log: logger, versions: map[string]time.Time{}}
+
+	if err := reloader.load(); err != nil {
+		log.Fatalf("failed to load TLS certificates: %q", err)
+	}
+
+	return reloader
+}
+
+// watch reloads the files every TLS_RELOAD_INTERVAL when one of them changed. A file that cannot be loaded is
+// logged and the previous certificate is kept.
+func (reloader *certificateReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(reloader.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !reloader.changed() {
+				continue
+			}
+
+			if err := reloader.load(); err != nil {
+				reloader.log.Error("failed to reload TLS certificates", zap.Error(err))
+				continue
+			}
+
+			reloader.log.Info("reloaded TLS certificates")
+		}
+	}
+}
+
+func (reloader *certificateReloader) files() []string {
+	files := []string{reloader.config.CertFile, reloader.config.KeyFile}
+	if reloader.config.ClientCAFile != "" {
+		files = append(files, reloader.config.ClientCAFile)
+	}
+
+	return files
+}
+
+// changed reports whether a file was modified since it was loaded. Kubernetes rotates secrets by swapping a symlink,
+// which os.Stat follows.
+func (reloader *certificateReloader) changed() bool {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+
+	for _, file := range reloader.files() {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(reloader.versions[file]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (reloader *certificateReloader) load() error {
+	versions := map[string]time.Time{}
+
+	for _, file := range reloader.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+
+		versions[file] = info.ModTime()
+	}
+
+	certificate, err := tls.LoadX509KeyPair(reloader.config.CertFile, reloader.config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+
+	if reloader.config.ClientCAFile != "" {
+		bundle, err := os.ReadFile(reloader.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(bundle) {
+			return fmt.Errorf("%s holds no PEM encoded certificate", reloader.config.ClientCAFile)
+		}
+	}
+
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+
+	reloader.certificate = &certificate
+	reloader.clientCAs = clientCAs
+	reloader.versions = versions
+
+	return nil
+}
+
+func (reloader *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+
+	return reloader.certificate, nil
+}
+
+func (reloader *certificateReloader) getClientCAs() *x509.CertPool {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+
+	return reloader.clientCAs
+}
+
+// clientCertificatePrincipal returns the principal of the verified client certificate of r. The subject is the
+// first URI SAN, a SPIFFE id for example, or the common name; the organizational units are the roles.
+func clientCertificatePrincipal(r *http.Request) (*Principal, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+
+	certificate := r.TLS.VerifiedChains[0][0]
+
+	subject := certificate.Subject.CommonName
+	if len(certificate.URIs) > 0 {
+		subject = certificate.URIs[0].String()
+	}
+
+	return &Principal{
+		Subject: subject,
+		Issuer:  certificate.Issuer.CommonName,
+		Method:  authMethodMTLS,
+		Roles:   certificate.Subject.OrganizationalUnit,
+		Claims: map[string]interface{}{
+			"serial_number": certificate.SerialNumber.String(),
+			"dns_names":     certificate.DNSNames,
+			"not_after":     certificate.NotAfter,
+		},
+	}, true
+}
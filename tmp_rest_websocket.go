@@ -0,0 +1,313 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// WebSocket is a WebSocket connection that receives In messages and sends Out messages, both as JSON text
+	// messages.
+	WebSocket[In any, Out any] struct {
+		conn     *websocket.Conn
+		route    string
+		server   *webSocketServer
+		limiter  *memoryRateLimiter
+		received atomic.Int64
+		sent     atomic.Int64
+	}
+
+	// webSocketServer holds what HandleWebSocket needs from the server, it is passed in the context of upgrade
+	// requests.
+	webSocketServer struct {
+		config           *webSocketConfig
+		messageRateLimit rateLimit
+		collector        *telemetry.MetricsCollector
+		log              *logging.Logger
+	}
+)
+
+const (
+	apiWebSocket = logging.ContextKey("apiWebSocket")
+
+	rejectedByWebSocket = "websocket"
+
+	reasonMessageRate     = "message_rate"
+	reasonMessageTooLarge = "message_too_large"
+
+	messageDirectionIn  = "in"
+	messageDirectionOut = "out"
+)
+
+var errWebSocketNotSetUp = errors.New("the WebSocket middleware is not set up for the route")
+
+func newWebSocketServer(
+	cfg *webSocketConfig,
+	collector *telemetry.MetricsCollector,
+	logger *logging.Logger,
+) *webSocketServer {
+	limit, err := parseRateLimit(cfg.MessageRateLimit)
+	if err != nil {
+		log.Fatalf("failed to configure websockets: %q", err)
+	}
+
+	return &webSocketServer{config: cfg, messageRateLimit: limit, collector: collector, log: logger}
+}
+
+// HandleWebSocket adapts fn to an http.HandlerFunc that upgrades requests to WebSocket connections and runs fn for
+// each one; requests that are not upgrades get 426 Upgrade Required. Routes registered with APIServer.handle go
+// through authentication and authorization before the upgrade, and pages may only open connections from the
+// origins in WEBSOCKET_ALLOWED_ORIGINS.
+//
+// fn must keep calling Read, pongs are read along with messages. Its context is cancelled when the connection
+// closes; when the server drains the connection is closed with 1001 Going Away. An error returned by fn closes the
+// connection with 1011 Internal Error. The request timeout of the route does not apply to connections.
+//
+//	func (handler *ChatEndpoint) Handler() http.HandlerFunc {
+//		return HandleWebSocket(handler.log, func(ctx context.Context, ws *WebSocket[chatMessage, chatMessage]) error {
+//			for {
+//				msg, err := ws.Read(ctx)
+//				if err != nil {
+//					return err
+//				}
+//
+//				if err := ws.Write(ctx, msg); err != nil {
+//					return err
+//				}
+//			}
+//		})
+//	}
+func HandleWebSocket[In any, Out any](
+	log *logging.Logger,
+	fn func(ctx context.Context, ws *WebSocket[In, Out]) error,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isWebSocketUpgrade(r) {
+			w.Header().Set("Upgrade", "websocket")
+			writeProblem(w, r, NewProblem(http.StatusUpgradeRequired, "the endpoint only serves WebSocket connections"))
+
+			return
+		}
+
+		server, ok := r.Context().Value(apiWebSocket).(*webSocketServer)
+		if !ok {
+			writeError(w, r, log, errWebSocketNotSetUp)
+			return
+		}
+
+		// the connection outlives HTTP_READ_TIMEOUT and HTTP_WRITE_TIMEOUT, pings and WEBSOCKET_WRITE_TIMEOUT bound it
+		controller := http.NewResponseController(w)
+		_ = controller.SetReadDeadline(time.Time{})
+		_ = controller.SetWriteDeadline(time.Time{})
+
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: server.config.AllowedOrigins})
+		if err != nil {
+			log.Info("failed to accept websocket connection", zap.String("http_url", r.URL.Path), zap.Error(err))
+			return
+		}
+
+		// one byte over WEBSOCKET_MAX_MESSAGE_BYTES, so that Read sees too large messages instead of the library
+		conn.SetReadLimit(server.config.MaxMessageBytes + 1)
+
+		ws := &WebSocket[In, Out]{
+			conn:    conn,
+			route:   routePattern(r),
+			server:  server,
+			limiter: &memoryRateLimiter{buckets: map[string]*tokenBucket{}, lastSweep: time.Now()},
+		}
+
+		ws.serve(r, fn)
+	}
+}
+
+// Read returns the next message of the connection. A message larger than WEBSOCKET_MAX_MESSAGE_BYTES, sent faster
+// than WEBSOCKET_MESSAGE_RATE_LIMIT allows or that does not decode into In closes the connection.
+func (ws *WebSocket[In, Out]) Read(ctx context.Context) (In, error) {
+	var msg In
+
+	_, reader, err := ws.conn.Reader(ctx)
+	if err != nil {
+		return msg, err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(reader, ws.server.config.MaxMessageBytes+1))
+	if err != nil {
+		return msg, err
+	}
+
+	if int64(len(data)) > ws.server.config.MaxMessageBytes {
+		ws.server.collector.RecordRejectedMetric(rejectedByWebSocket, reasonMessageTooLarge)
+
+		return msg, ws.close(
+			websocket.StatusMessageTooBig,
+			fmt.Sprintf("messages are limited to %d bytes", ws.server.config.MaxMessageBytes),
+		)
+	}
+
+	if result, _ := ws.limiter.allow(ctx, "", ws.server.messageRateLimit); !result.allowed {
+		ws.server.collector.RecordRejectedMetric(rejectedByWebSocket, reasonMessageRate)
+
+		return msg, ws.close(websocket.StatusPolicyViolation, "too many messages")
+	}
+
+	ws.received.Add(1)
+	ws.server.collector.RecordMessageMetric(ws.route, messageDirectionIn)
+
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return msg, ws.close(websocket.StatusInvalidFramePayloadData, "message is not valid JSON")
+	}
+
+	return msg, nil
+}
+
+// Write sends msg on the connection, it gives up after WEBSOCKET_WRITE_TIMEOUT. Write is safe for concurrent use.
+func (ws *WebSocket[In, Out]) Write(ctx context.Context, msg Out) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ws.server.config.WriteTimeout)
+	defer cancel()
+
+	if err := ws.conn.Write(ctx, websocket.MessageText, data); err != nil {
+		return err
+	}
+
+	ws.sent.Add(1)
+	ws.server.collector.RecordMessageMetric(ws.route, messageDirectionOut)
+
+	return nil
+}
+
+// Close closes the connection with code and reason.
+func (ws *WebSocket[In, Out]) Close(code websocket.StatusCode, reason string) error {
+	return ws.conn.Close(code, reason)
+}
+
+// serve runs fn in the span of the connection, keeping the connection alive with pings until fn returns.
+func (ws *WebSocket[In, Out]) serve(r *http.Request, fn func(ctx context.Context, ws *WebSocket[In, Out]) error) {
+	ctx, span := otel.Tracer("api-server").Start(
+		context.WithoutCancel(r.Context()),
+		"websocket "+ws.route,
+		trace.WithAttributes(attribute.String("http.route", ws.route)),
+	)
+	defer span.End()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ws.server.collector.RecordSocketMetric(ws.route, 1)
+	defer ws.server.collector.RecordSocketMetric(ws.route, -1)
+
+	go ws.keepAlive(ctx, cancel)
+
+	go func() {
+		select {
+		case <-Draining(r.Context()):
+			_ = ws.close(websocket.StatusGoingAway, "server is shutting down")
+		case <-ctx.Done():
+		}
+	}()
+
+	err := fn(ctx, ws)
+
+	status := websocket.CloseStatus(err)
+
+	span.SetAttributes(
+		attribute.Int64("websocket.messages.received", ws.received.Load()),
+		attribute.Int64("websocket.messages.sent", ws.sent.Load()),
+		attribute.Int("websocket.close_code", int(status)),
+	)
+
+	switch {
+	case err == nil:
+		_ = ws.conn.Close(websocket.StatusNormalClosure, "")
+	case status != -1 || errors.Is(err, context.Canceled) || errors.Is(err, net.ErrClosed):
+		// the connection was closed by the client, by the server or by the keep alive
+		_ = ws.conn.CloseNow()
+	default:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+
+		ws.server.log.Error(
+			"websocket connection failed",
+			zap.String("http_route", ws.route),
+			logging.CorrelationIDField(logging.GetCorrelationIDFromCtx(r.Context())),
+			zap.Error(err),
+		)
+
+		_ = ws.conn.Close(websocket.StatusInternalError, "")
+	}
+}
+
+// keepAlive pings the client every WEBSOCKET_PING_INTERVAL and closes the connection when a pong does not come
+// back within WEBSOCKET_PONG_TIMEOUT.
+func (ws *WebSocket[In, Out]) keepAlive(ctx context.Context, cancel context.CancelFunc) {
+	ticker := time.NewTicker(ws.server.config.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pingCtx, cancelPing := context.WithTimeout(ctx, ws.server.config.PongTimeout)
+			err := ws.conn.Ping(pingCtx)
+			cancelPing()
+
+			if err != nil {
+				_ = ws.conn.CloseNow()
+				cancel()
+
+				return
+			}
+		}
+	}
+}
+
+// close closes the connection with code and reason and returns the error Read reports for it.
+func (ws *WebSocket[In, Out]) close(code websocket.StatusCode, reason string) error {
+	_ = ws.conn.Close(code, reason)
+
+	return websocket.CloseError{Code: code, Reason: reason}
+}
+
+// serverWebSocketMiddleware passes server to HandleWebSocket in the context of upgrade requests.
+func serverWebSocketMiddleware(server *webSocketServer, log *logging.Logger) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if isWebSocketUpgrade(r) {
+				r = r.WithContext(context.WithValue(r.Context(), apiWebSocket, server))
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		log.Debug("use server websocket middleware")
+		return http.HandlerFunc(fn)
+	}
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
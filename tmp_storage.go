@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+type (
+	// BlobStore keeps blobs under keys such as "invoices/2024/42.pdf". Get and Stat return ErrNotFound for keys that
+	// hold no blob and every method returns ErrInvalidKey for keys that are empty, absolute or contain "..".
+	BlobStore interface {
+		// Put stores body under key, replacing the blob it held. The blob is only visible once body is read to the
+		// end; when reading body fails nothing is stored.
+		Put(ctx context.Context, key string, body io.Reader, opts PutOptions) (*BlobInfo, error)
+		// Get returns the blob under key, or the part of it in rng when rng is not nil. It returns ErrInvalidRange
+		// when rng is empty or starts past the end of the blob. Close the blob once it is read.
+		Get(ctx context.Context, key string, rng *Range) (*Blob, error)
+		Stat(ctx context.Context, key string) (*BlobInfo, error)
+		Delete(ctx context.Context, key string) error
+	}
+
+	// BlobInfo describes a blob. ETag changes whenever the content of the blob changes. Checksum is the hex
+	// encoded SHA-256 of the content; it is always set by Put, Stat and Get only set it when the store keeps it.
+	BlobInfo struct {
+		Key         string    `json:"key"`
+		Size        int64     `json:"size"`
+		ContentType string    `json:"content_type"`
+		ETag        string    `json:"etag"`
+		Checksum    string    `json:"checksum,omitempty"`
+		ModTime     time.Time `json:"mod_time"`
+	}
+
+	// Blob is the content of a blob, or of the Range of it that was asked for.
+	Blob struct {
+		io.ReadCloser
+
+		Info  BlobInfo
+		Range *Range
+	}
+
+	// PutOptions describe the blob to Put. Size is -1 when it is not known up front.
+	PutOptions struct {
+		ContentType string
+		Size        int64
+	}
+
+	// Range is the part of a blob from Offset on, Length bytes long.
+	Range struct {
+		Offset int64
+		Length int64
+	}
+
+	// checksumReader hashes what is read through it.
+	checksumReader struct {
+		reader io.Reader
+		hash   hash.Hash
+		size   int64
+	}
+
+	// instrumentedStore records the duration of the operations of a BlobStore and the bytes they transfer.
+	instrumentedStore struct {
+		store     BlobStore
+		collector *telemetry.MetricsCollector
+	}
+
+	// instrumentedBlob records a Get once the blob has been read and closed.
+	instrumentedBlob struct {
+		io.ReadCloser
+
+		collector *telemetry.MetricsCollector
+		startTime time.Time
+		read      int64
+	}
+
+	config struct {
+		// Backend is local or s3.
+		Backend  string `envconfig:"STORAGE_BACKEND" default:"local"`
+		LocalDir string `envconfig:"STORAGE_LOCAL_DIR" default:"data/blobs"`
+		S3       *s3Config
+	}
+
+	s3Config struct {
+		// Endpoint is the host and port of the S3 compatible API, for example s3.eu-west-1.amazonaws.com or minio:9000.
+		Endpoint        string `envconfig:"STORAGE_S3_ENDPOINT" default:"s3.amazonaws.com"`
+		Region          string `envconfig:"STORAGE_S3_REGION"`
+		Bucket          string `envconfig:"STORAGE_S3_BUCKET"`
+		AccessKeyID     string `envconfig:"STORAGE_S3_ACCESS_KEY_ID"`
+		SecretAccessKey string `envconfig:"STORAGE_S3_SECRET_ACCESS_KEY"`
+		UseSSL          bool   `envconfig:"STORAGE_S3_USE_SSL" default:"true"`
+		// CreateBucket creates the bucket at start up when it does not exist, for local development against MinIO.
+		CreateBucket bool `envconfig:"STORAGE_S3_CREATE_BUCKET" default:"false"`
+		// PartSize is the size of the parts blobs of unknown size are uploaded in, buffered in memory one at a time.
+		// S3 takes at least 5 MiB and at most 10000 parts, so it also bounds the size of such blobs.
+		PartSize uint64 `envconfig:"STORAGE_S3_PART_SIZE" default:"16777216"`
+	}
+)
+
+const (
+	backendLocal = "local"
+	backendS3    = "s3"
+
+	putMethod    = "put"
+	getMethod    = "get"
+	statMethod   = "stat"
+	deleteMethod = "delete"
+
+	defaultContentType = "application/octet-stream"
+)
+
+var (
+	// ErrNotFound is returned when a key holds no blob.
+	ErrNotFound = errors.New("blob not found")
+
+	// ErrInvalidKey is returned for keys that could escape the store.
+	ErrInvalidKey = errors.New("invalid blob key")
+
+	// ErrInvalidRange is returned when a range is empty or starts past the end of the blob.
+	ErrInvalidRange = errors.New("range not satisfiable")
+)
+
+func newConfig() *config {
+	cfg := new(config)
+	err := envconfig.Process("", cfg)
+	if err != nil {
+		log.Fatalf("failed to load storage configuration: %q", err)
+	}
+
+	return cfg
+}
+
+// NewBlobStore returns the BlobStore selected by STORAGE_BACKEND: a directory of the local filesystem or a bucket
+// of an S3 compatible API such as AWS S3 or MinIO.
+func NewBlobStore(instrumentation *telemetry.Instrumentation) BlobStore {
+	cfg := newConfig()
+
+	var store BlobStore
+
+	switch cfg.Backend {
+	case backendLocal:
+		store = newLocalStore(cfg.LocalDir)
+	case backendS3:
+		store = newS3Store(cfg.S3)
+	default:
+		log.Fatalf("failed to create blob store: unknown backend %q", cfg.Backend)
+	}
+
+	return &instrumentedStore{store: store, collector: newMetricsCollector(instrumentation)}
+}
+
+func newMetricsCollector(instrumentation *telemetry.Instrumentation) *telemetry.MetricsCollector {
+	collector := telemetry.NewMetricsCollector(
+		"storage",
+		telemetry.TotalOperations(),
+		telemetry.LatencyWithLabels(),
+		telemetry.TransferredBytesWithLabels(),
+	)
+
+	instrumentation.Registry().MustRegister(
+		collector.Counter(),
+		collector.LatencyVec(),
+		collector.BytesVec(),
+	)
+
+	return collector
+}
+
+// Put implements BlobStore.
+func (store *instrumentedStore) Put(
+	ctx context.Context,
+	key string,
+	body io.Reader,
+	opts PutOptions,
+) (*BlobInfo, error) {
+	store.collector.RecordTotalOpsMetric()
+	defer store.collector.RecordLatencyMetricWithLabels(time.Now(), putMethod)
+
+	info, err := store.store.Put(ctx, key, body, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	store.collector.RecordTransferredBytesMetric(putMethod, info.Size)
+
+	return info, nil
+}
+
+// Get implements BlobStore. The duration of a Get runs until the blob is closed.
+func (store *instrumentedStore) Get(ctx context.Context, key string, rng *Range) (*Blob, error) {
+	store.collector.RecordTotalOpsMetric()
+	startTime := time.Now()
+
+	blob, err := store.store.Get(ctx, key, rng)
+	if err != nil {
+		store.collector.RecordLatencyMetricWithLabels(startTime, getMethod)
+		return nil, err
+	}
+
+	blob.ReadCloser = &instrumentedBlob{ReadCloser: blob.ReadCloser, collector: store.collector, startTime: startTime}
+
+	return blob, nil
+}
+
+// Stat implements BlobStore.
+func (store *instrumentedStore) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	store.collector.RecordTotalOpsMetric()
+	defer store.collector.RecordLatencyMetricWithLabels(time.Now(), statMethod)
+
+	return store.store.Stat(ctx, key)
+}
+
+// Delete implements BlobStore.
+func (store *instrumentedStore) Delete(ctx context.Context, key string) error {
+	store.collector.RecordTotalOpsMetric()
+	defer store.collector.RecordLatencyMetricWithLabels(time.Now(), deleteMethod)
+
+	return store.store.Delete(ctx, key)
+}
+
+// Read implements io.Reader.
+func (blob *instrumentedBlob) Read(p []byte) (int, error) {
+	n, err := blob.ReadCloser.Read(p)
+	blob.read += int64(n)
+
+	return n, err
+}
+
+// Close implements io.Closer.
+func (blob *instrumentedBlob) Close() error {
+	blob.collector.RecordLatencyMetricWithLabels(blob.startTime, getMethod)
+	blob.collector.RecordTransferredBytesMetric(getMethod, blob.read)
+
+	return blob.ReadCloser.Close()
+}
+
+func newChecksumReader(reader io.Reader) *checksumReader {
+	return &checksumReader{reader: reader, hash: sha256.New()}
+}
+
+// Read implements io.Reader.
+func (reader *checksumReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.hash.Write(p[:n])
+	reader.size += int64(n)
+
+	return n, err
+}
+
+func (reader *checksumReader) checksum() string {
+	return hex.EncodeToString(reader.hash.Sum(nil))
+}
+
+// cleanKey returns key in its canonical form, or ErrInvalidKey.
+func cleanKey(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return "", ErrInvalidKey
+	}
+
+	for _, segment := range strings.Split(key, "/") {
+		if segment == ".." {
+			return "", ErrInvalidKey
+		}
+	}
+
+	return path.Clean(key), nil
+}
+
+func contentType(opts PutOptions) string {
+	if opts.ContentType == "" {
+		return defaultContentType
+	}
+
+	return opts.ContentType
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+type (
+	// localStore keeps blobs in a directory of the local filesystem, under blobs/<key>: the content followed by a
+	// trailer describing it. Blobs are written to tmp/ first and renamed, so readers never see a partial blob nor
+	// the content of one blob with the checksum of another.
+	localStore struct {
+		dir string
+	}
+
+	localMeta struct {
+		ContentType string `json:"content_type"`
+		Checksum    string `json:"checksum"`
+	}
+)
+
+const (
+	localBlobsDir = "blobs"
+	localTmpDir   = "tmp"
+
+	// localTrailerLen is the length of the end of the trailer, the length of the JSON encoded localMeta before it.
+	localTrailerLen = 8
+
+	localDirPerm = 0o750
+)
+
+var errInvalidTrailer = errors.New("invalid blob trailer")
+
+func newLocalStore(dir string) *localStore {
+	for _, sub := range []string{localBlobsDir, localTmpDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), localDirPerm); err != nil {
+			log.Fatalf("failed to create blob store directory: %q", err)
+		}
+	}
+
+	return &localStore{dir: dir}
+}
+
+// Put implements BlobStore.
+func (store *localStore) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) (*BlobInfo, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(store.dir, localTmpDir), "put-*")
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	reader := newChecksumReader(body)
+
+	if _, err := io.Copy(tmp, reader); err != nil {
+		_ = tmp.Close()
+		return nil, err
+	}
+
+	if err := writeTrailer(tmp, localMeta{ContentType: contentType(opts), Checksum: reader.checksum()}); err != nil {
+		_ = tmp.Close()
+		return nil, err
+	}
+
+	if err := errors.Join(tmp.Sync(), tmp.Close(), ctx.Err()); err != nil {
+		return nil, err
+	}
+
+	blobPath := store.blobPath(key)
+
+	if err := os.MkdirAll(filepath.Dir(blobPath), localDirPerm); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmp.Name(), blobPath); err != nil {
+		return nil, err
+	}
+
+	return store.Stat(ctx, key)
+}
+
+// Get implements BlobStore.
+func (store *localStore) Get(_ context.Context, key string, rng *Range) (*Blob, error) {
+	file, info, err := store.open(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var limited *Range
+
+	// the section leaves the trailer out
+	offset, length := int64(0), info.Size
+
+	if rng != nil {
+		if rng.Offset >= info.Size || rng.Length < 1 {
+			_ = file.Close()
+			return nil, ErrInvalidRange
+		}
+
+		limited = &Range{Offset: rng.Offset, Length: min(rng.Length, info.Size-rng.Offset)}
+		offset, length = limited.Offset, limited.Length
+	}
+
+	return &Blob{
+		ReadCloser: struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(file, offset, length), file},
+		Info:  *info,
+		Range: limited,
+	}, nil
+}
+
+// Stat implements BlobStore.
+func (store *localStore) Stat(_ context.Context, key string) (*BlobInfo, error) {
+	file, info, err := store.open(key)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = file.Close()
+
+	return info, nil
+}
+
+// Delete implements BlobStore.
+func (store *localStore) Delete(_ context.Context, key string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(store.blobPath(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// open opens the blob under key and reads what describes it from the same file, so that both belong to the same
+// Put even when another one replaces the blob meanwhile.
+func (store *localStore) open(key string) (*os.File, *BlobInfo, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(store.blobPath(key))
+	if err != nil {
+		return nil, nil, notFound(err)
+	}
+
+	info, err := readInfo(file, key)
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+
+	return file, info, nil
+}
+
+func (store *localStore) blobPath(key string) string {
+	return filepath.Join(store.dir, localBlobsDir, filepath.FromSlash(key))
+}
+
+// writeTrailer appends meta to the content written to file, followed by its length.
+func writeTrailer(file *os.File, meta localMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	data = binary.BigEndian.AppendUint64(data, uint64(len(data)))
+
+	_, err = file.Write(data)
+
+	return err
+}
+
+func readInfo(file *os.File, key string) (*BlobInfo, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if stat.IsDir() {
+		return nil, ErrNotFound
+	}
+
+	if stat.Size() < localTrailerLen {
+		return nil, fmt.Errorf("blob %s: %w", key, errInvalidTrailer)
+	}
+
+	end := make([]byte, localTrailerLen)
+	if _, err := file.ReadAt(end, stat.Size()-localTrailerLen); err != nil {
+		return nil, err
+	}
+
+	metaLen := binary.BigEndian.Uint64(end)
+	if metaLen > uint64(stat.Size()-localTrailerLen) {
+		return nil, fmt.Errorf("blob %s: %w", key, errInvalidTrailer)
+	}
+
+	size := stat.Size() - localTrailerLen - int64(metaLen)
+
+	data := make([]byte, metaLen)
+	if _, err := file.ReadAt(data, size); err != nil {
+		return nil, err
+	}
+
+	meta := new(localMeta)
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("blob %s: %w: %w", key, errInvalidTrailer, err)
+	}
+
+	return &BlobInfo{
+		Key:         key,
+		Size:        size,
+		ContentType: meta.ContentType,
+		ETag:        fmt.Sprintf("%q", meta.Checksum),
+		Checksum:    meta.Checksum,
+		ModTime:     stat.ModTime(),
+	}, nil
+}
+
+func notFound(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+
+	return err
+}
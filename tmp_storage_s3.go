@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3Store keeps blobs in a bucket of an S3 compatible API. S3 does not keep the checksum Put computes, so Stat and
+// Get leave BlobInfo.Checksum empty; the ETag S3 returns identifies the content instead.
+type s3Store struct {
+	client   *minio.Client
+	bucket   string
+	partSize uint64
+}
+
+const (
+	s3StartUpTimeout = 10 * time.Second
+	s3MinPartSize    = 5 << 20
+
+	s3NoSuchKey          = "NoSuchKey"
+	s3InvalidRange       = "InvalidRange"
+	s3BucketAlreadyOwned = "BucketAlreadyOwnedByYou"
+)
+
+func newS3Store(cfg *s3Config) *s3Store {
+	if cfg.Bucket == "" {
+		log.Fatalf("failed to create blob store: STORAGE_S3_BUCKET is not set")
+	}
+
+	if cfg.PartSize < s3MinPartSize {
+		log.Fatalf("failed to create blob store: STORAGE_S3_PART_SIZE must be at least %d bytes", s3MinPartSize)
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		log.Fatalf("failed to create blob store: %q", err)
+	}
+
+	if cfg.CreateBucket {
+		ctx, cancel := context.WithTimeout(context.Background(), s3StartUpTimeout)
+		defer cancel()
+
+		err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region})
+		if err != nil && minio.ToErrorResponse(err).Code != s3BucketAlreadyOwned {
+			log.Fatalf("failed to create bucket %q: %q", cfg.Bucket, err)
+		}
+	}
+
+	return &s3Store{client: client, bucket: cfg.Bucket, partSize: cfg.PartSize}
+}
+
+// Put implements BlobStore.
+func (store *s3Store) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) (*BlobInfo, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := newChecksumReader(body)
+
+	upload, err := store.client.PutObject(
+		ctx,
+		store.bucket,
+		key,
+		reader,
+		opts.Size,
+		// without a size minio buffers whole parts, over 500 MiB each unless PartSize is set
+		minio.PutObjectOptions{ContentType: contentType(opts), PartSize: store.partSize},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	modTime := upload.LastModified
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+
+	return &BlobInfo{
+		Key:         key,
+		Size:        upload.Size,
+		ContentType: contentType(opts),
+		ETag:        quoteETag(upload.ETag),
+		Checksum:    reader.checksum(),
+		ModTime:     modTime,
+	}, nil
+}
+
+// Get implements BlobStore.
+func (store *s3Store) Get(ctx context.Context, key string, rng *Range) (*Blob, error) {
+	info, err := store.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := minio.GetObjectOptions{}
+	// the object must not change between Stat and Get
+	if err := opts.SetMatchETag(strings.Trim(info.ETag, `"`)); err != nil {
+		return nil, err
+	}
+
+	var limited *Range
+
+	if rng != nil {
+		if rng.Offset >= info.Size || rng.Length < 1 {
+			return nil, ErrInvalidRange
+		}
+
+		limited = &Range{Offset: rng.Offset, Length: min(rng.Length, info.Size-rng.Offset)}
+
+		if err := opts.SetRange(limited.Offset, limited.Offset+limited.Length-1); err != nil {
+			return nil, err
+		}
+	}
+
+	object, err := store.client.GetObject(ctx, store.bucket, info.Key, opts)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	return &Blob{ReadCloser: object, Info: *info, Range: limited}, nil
+}
+
+// Stat implements BlobStore.
+func (store *s3Store) Stat(ctx context.Context, key string) (*BlobInfo, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := store.client.StatObject(ctx, store.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	return &BlobInfo{
+		Key:         key,
+		Size:        object.Size,
+		ContentType: object.ContentType,
+		ETag:        quoteETag(object.ETag),
+		ModTime:     object.LastModified,
+	}, nil
+}
+
+// Delete implements BlobStore.
+func (store *s3Store) Delete(ctx context.Context, key string) error {
+	key, err := cleanKey(key)
+	if err != nil {
+		return err
+	}
+
+	return s3Error(store.client.RemoveObject(ctx, store.bucket, key, minio.RemoveObjectOptions{}))
+}
+
+// quoteETag returns etag as an entity tag, minio strips the quotes S3 sends.
+func quoteETag(etag string) string {
+	if len(etag) > 1 && etag[0] == '"' {
+		return etag
+	}
+
+	return `"` + etag + `"`
+}
+
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch minio.ToErrorResponse(err).Code {
+	case s3NoSuchKey:
+		return ErrNotFound
+	case s3InvalidRange:
+		return ErrInvalidRange
+	}
+
+	return err
+}
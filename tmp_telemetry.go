@@ -20,6 +20,12 @@ type (
 		counter    promClient.Counter
 		counterVec *promClient.CounterVec
 		latencyVec *promClient.HistogramVec
+		rowsVec    *promClient.CounterVec
+		rejectVec  *promClient.CounterVec
+		socketVec  *promClient.GaugeVec
+		messageVec *promClient.CounterVec
+		bytesVec   *promClient.CounterVec
+		panicVec   *promClient.CounterVec
 	}
 
 	// HTTPMetricLabels defines the fields in an HTTP metric that is collected.
@@ -80,6 +86,30 @@ func (collector *MetricsCollector) LatencyVec() *promClient.HistogramVec {
 	return collector.latencyVec
 }
 
+func (collector *MetricsCollector) RowsVec() *promClient.CounterVec {
+	return collector.rowsVec
+}
+
+func (collector *MetricsCollector) RejectVec() *promClient.CounterVec {
+	return collector.rejectVec
+}
+
+func (collector *MetricsCollector) SocketVec() *promClient.GaugeVec {
+	return collector.socketVec
+}
+
+func (collector *MetricsCollector) MessageVec() *promClient.CounterVec {
+	return collector.messageVec
+}
+
+func (collector *MetricsCollector) BytesVec() *promClient.CounterVec {
+	return collector.bytesVec
+}
+
+func (collector *MetricsCollector) PanicVec() *promClient.CounterVec {
+	return collector.panicVec
+}
+
 func (fn collectorMetricFunc) Apply(collector *MetricsCollector, name string) {
 	fn(collector, name)
 }
@@ -162,6 +192,75 @@ func TotalHTTPOperationsWithLabels() CollectorMetric {
 	})
 }
 
+func RowsAffectedWithLabels() CollectorMetric {
+	return collectorMetricFunc(func(collector *MetricsCollector, name string) {
+		collector.rowsVec = promauto.NewCounterVec(
+			promClient.CounterOpts{
+				Name: fmt.Sprintf("%s_rows_affected_total", name),
+				Help: "The total number of database rows affected by operations grouped by labels",
+			},
+			[]string{"method", "tag"},
+		)
+	})
+}
+
+func RejectionsWithLabels() CollectorMetric {
+	return collectorMetricFunc(func(collector *MetricsCollector, name string) {
+		collector.rejectVec = promauto.NewCounterVec(
+			promClient.CounterOpts{
+				Name: fmt.Sprintf("%s_rejected_ops_total", name),
+				Help: "The total number of rejected operations grouped by the rejecting component and reason",
+			},
+			[]string{"source", "reason", "tag"},
+		)
+	})
+}
+
+func TransferredBytesWithLabels() CollectorMetric {
+	return collectorMetricFunc(func(collector *MetricsCollector, name string) {
+		collector.bytesVec = promauto.NewCounterVec(
+			promClient.CounterOpts{
+				Name: fmt.Sprintf("%s_transferred_bytes_total", name),
+				Help: "The total number of bytes transferred by operations grouped by labels",
+			},
+			[]string{"method", "tag"},
+		)
+	})
+}
+
+// PanicsWithLabels collects the panics recovered from, by the request handler or worker that panicked.
+func PanicsWithLabels() CollectorMetric {
+	return collectorMetricFunc(func(collector *MetricsCollector, name string) {
+		collector.panicVec = promauto.NewCounterVec(
+			promClient.CounterOpts{
+				Name: fmt.Sprintf("%s_panics_total", name),
+				Help: "The total number of recovered panics grouped by source",
+			},
+			[]string{"source", "tag"},
+		)
+	})
+}
+
+// WebSocketsWithLabels collects the open WebSocket connections and the messages they carried, by route.
+func WebSocketsWithLabels() CollectorMetric {
+	return collectorMetricFunc(func(collector *MetricsCollector, name string) {
+		collector.socketVec = promauto.NewGaugeVec(
+			promClient.GaugeOpts{
+				Name: fmt.Sprintf("%s_websocket_connections", name),
+				Help: "The number of open WebSocket connections grouped by route",
+			},
+			[]string{"url", "tag"},
+		)
+		collector.messageVec = promauto.NewCounterVec(
+			promClient.CounterOpts{
+				Name: fmt.Sprintf("%s_websocket_messages_total", name),
+				Help: "The total number of WebSocket messages grouped by route and direction",
+			},
+			[]string{"url", "direction", "tag"},
+		)
+	})
+}
+
 func (collector *MetricsCollector) RecordLatencyMetric(startTime time.Time) {
 	collector.latencyVec.With(
 		promClient.Labels{
@@ -219,6 +318,64 @@ func (collector *MetricsCollector) RecordHTTPMetric(params *HTTPMetricLabels) {
 	).Inc()
 }
 
+func (collector *MetricsCollector) RecordRowsAffectedMetric(method string, rows int64) {
+	collector.rowsVec.With(
+		promClient.Labels{
+			"tag":    collector.tag,
+			"method": method,
+		},
+	).Add(float64(rows))
+}
+
+func (collector *MetricsCollector) RecordRejectedMetric(source, reason string) {
+	collector.rejectVec.With(
+		promClient.Labels{
+			"tag":    collector.tag,
+			"source": source,
+			"reason": reason,
+		},
+	).Inc()
+}
+
+func (collector *MetricsCollector) RecordPanicMetric(source string) {
+	collector.panicVec.With(
+		promClient.Labels{
+			"tag":    collector.tag,
+			"source": source,
+		},
+	).Inc()
+}
+
+func (collector *MetricsCollector) RecordTransferredBytesMetric(method string, bytes int64) {
+	collector.bytesVec.With(
+		promClient.Labels{
+			"tag":    collector.tag,
+			"method": method,
+		},
+	).Add(float64(bytes))
+}
+
+// RecordSocketMetric adds delta, 1 or -1, to the open WebSocket connections of url.
+func (collector *MetricsCollector) RecordSocketMetric(url string, delta float64) {
+	collector.socketVec.With(
+		promClient.Labels{
+			"tag": collector.tag,
+			"url": url,
+		},
+	).Add(delta)
+}
+
+// RecordMessageMetric counts a WebSocket message of url, direction is in or out.
+func (collector *MetricsCollector) RecordMessageMetric(url, direction string) {
+	collector.messageVec.With(
+		promClient.Labels{
+			"tag":       collector.tag,
+			"url":       url,
+			"direction": direction,
+		},
+	).Inc()
+}
+
 func (collector *MetricsCollector) RecordTotalOpsMetric() {
 	collector.counter.Inc()
 }
@@ -11,6 +11,7 @@ import (
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/jaeger"
 	"go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdkTrace "go.opentelemetry.io/otel/sdk/trace"
@@ -184,6 +185,9 @@ func NewInstrumentation(registry *promClient.Registry) *Instrumentation {
 	}
 
 	otel.SetTracerProvider(traceProvider)
+	// W3C trace context is read from incoming requests and written to outgoing ones by the otelhttp handler and
+	// transport, so that traces span services.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
 
 	return &Instrumentation{
 		serviceName:   serviceName,
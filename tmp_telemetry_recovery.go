@@ -0,0 +1,118 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	{{range .imports}}
+	"{{.}}"
+	{{- end}}
+)
+
+// PanicError is a panic that was recovered from, with the stack of the goroutine that panicked.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+// Error implements the error interface.
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %+v", e.Value)
+}
+
+// Unwrap returns the value of the panic when it is an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+
+	return err
+}
+
+// ReportPanic reports the panic rec recovered from: it logs it with its stack, the request and correlation ids of
+// ctx and fields, records it as an exception on the span of ctx and counts it under source when collector is not
+// nil. Call it from the deferred function that recovered, so that the stack is the one of the panic.
+func ReportPanic(
+	ctx context.Context,
+	log *zap.Logger,
+	collector *MetricsCollector,
+	source string,
+	rec interface{},
+	fields ...zap.Field,
+) *PanicError {
+	panicErr := &PanicError{Value: rec, Stack: debug.Stack()}
+
+	log.Error(
+		"recovered from panic",
+		append(
+			[]zap.Field{
+				zap.String("panic", fmt.Sprintf("%+v", rec)),
+				zap.String("source", source),
+				logging.RequestIDField(logging.GetRequestIDFromCtx(ctx)),
+				logging.CorrelationIDField(logging.GetCorrelationIDFromCtx(ctx)),
+				zap.String("stack", string(panicErr.Stack)),
+			},
+			fields...,
+		)...,
+	)
+
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(panicErr, trace.WithAttributes(attribute.String("exception.stacktrace", string(panicErr.Stack))))
+	span.SetStatus(codes.Error, panicErr.Error())
+
+	if collector != nil && collector.panicVec != nil {
+		collector.RecordPanicMetric(source)
+	}
+
+	return panicErr
+}
+
+// Safely runs fn and returns its error, or a *PanicError reported with ReportPanic when fn panics. Use it around the
+// work of workers and consumers so that one bad job does not take the process down:
+//
+//	for msg := range messages {
+//		err := telemetry.Safely(ctx, log.Logger, collector, "orders-consumer", func(ctx context.Context) error {
+//			return consumer.handle(ctx, msg)
+//		})
+//		...
+//	}
+func Safely(
+	ctx context.Context,
+	log *zap.Logger,
+	collector *MetricsCollector,
+	source string,
+	fn func(ctx context.Context) error,
+) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = ReportPanic(ctx, log, collector, source, rec)
+		}
+	}()
+
+	return fn(ctx)
+}
+
+// Go runs fn in a new goroutine with Safely, errors returned by fn are logged.
+func Go(
+	ctx context.Context,
+	log *zap.Logger,
+	collector *MetricsCollector,
+	source string,
+	fn func(ctx context.Context) error,
+) {
+	go func() {
+		err := Safely(ctx, log, collector, source, fn)
+		if err == nil {
+			return
+		}
+
+		var panicErr *PanicError
+		if !errors.As(err, &panicErr) {
+			log.Error("background task failed", zap.String("source", source), zap.Error(err))
+		}
+	}()
+}
@@ -0,0 +1,47 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"regexp"
+)
+
+type contextKey string
+
+const (
+	tenantKey = contextKey("tenant")
+)
+
+var (
+	// ErrMissing is returned when a tenant is required but the context does not carry one.
+	ErrMissing = errors.New("tenant is missing")
+
+	// ErrInvalid is returned for tenant IDs that are not safe to use as a schema name or session variable.
+	ErrInvalid = errors.New("tenant is invalid")
+
+	idPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,47}$`)
+)
+
+// Validate checks that id is a lower case identifier that can be used to build a schema name.
+func Validate(id string) error {
+	if !idPattern.MatchString(id) {
+		return ErrInvalid
+	}
+
+	return nil
+}
+
+// NewContext returns a copy of ctx that carries the tenant id.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, tenantKey, id)
+}
+
+// FromContext returns the tenant id carried by ctx.
+func FromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(tenantKey).(string)
+	if !ok || id == "" {
+		return "", false
+	}
+
+	return id, true
+}